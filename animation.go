@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+// Animation is a decoded animated image. Every frame is fully composed on the
+// canvas, so frames can be scaled independently of the source disposal modes.
+// Format is the format scaled variants are written in: "gif" for GIF sources,
+// "png" (APNG) for everything else. LoopCount follows the image/gif convention.
+type Animation struct {
+	Frames    []*image.RGBA
+	Delays    []int // milliseconds
+	LoopCount int
+	Format    string
+}
+
+// maxAnimationPixels limits the pixels of all frames of an animation, as
+// they are held in memory at once while scaling.
+const maxAnimationPixels = 1 << 26
+
+var errAnimationTooLarge = errors.New("animation too large")
+
+// decodeAnimation decodes an animated GIF, APNG or WebP. It returns nil
+// without an error for still images.
+func decodeAnimation(src []byte, format string) (*Animation, error) {
+	if frames, _ := animationFrameInfo(src, format); frames > 1 {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		if frames*cfg.Width*cfg.Height > maxAnimationPixels {
+			return nil, errAnimationTooLarge
+		}
+	}
+	var anim *Animation
+	var err error
+	switch format {
+	case "gif":
+		anim, err = decodeGIFAnimation(src)
+	case "png":
+		if !isAPNG(src) {
+			return nil, nil
+		}
+		anim, err = decodeAPNGAnimation(src)
+	case "webp":
+		if !isAnimatedWebP(src) {
+			return nil, nil
+		}
+		anim, err = decodeWebPAnimation(src)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(anim.Frames) < 2 {
+		return nil, nil
+	}
+	return anim, nil
+}
+
+func encodeAnimation(w io.Writer, anim *Animation) error {
+	if anim.Format == "gif" {
+		return encodeGIFAnimation(w, anim)
+	}
+	return encodeAPNG(w, anim)
+}
+
+// animationFormat detects animated formats image.DecodeConfig does not
+// recognize on its own.
+func animationFormat(src []byte) string {
+	switch {
+	case bytes.HasPrefix(src, []byte("GIF8")):
+		return "gif"
+	case bytes.HasPrefix(src, pngSignature):
+		return "png"
+	case len(src) >= 12 && string(src[:4]) == "RIFF" && string(src[8:12]) == "WEBP":
+		return "webp"
+	}
+	return ""
+}
+
+// animationFrameInfo returns the number of frames and the total duration in
+// milliseconds of an animated image, or zeros for still images.
+func animationFrameInfo(src []byte, format string) (int, int) {
+	switch format {
+	case "gif":
+		frames, duration, err := gifFrameInfo(bytes.NewReader(src))
+		if err != nil {
+			L().Debug("gif frame info:", err)
+			return 0, 0
+		}
+		return frames, duration
+	case "png":
+		return apngFrameInfo(src)
+	case "webp":
+		return webpFrameInfo(src)
+	}
+	return 0, 0
+}
+
+// loopCount converts the number of plays of APNG and WebP, 0 meaning forever,
+// to the image/gif convention.
+func loopCount(plays int) int {
+	switch plays {
+	case 0:
+		return 0
+	case 1:
+		return -1
+	}
+	return plays - 1
+}
+
+func (a *Animation) Duration() int {
+	d := 0
+	for _, v := range a.Delays {
+		d += v
+	}
+	return d
+}
+
+func cloneRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Rect)
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// decodeGIFAnimation decodes all frames of a GIF and composes them according
+// to their disposal methods.
+func decodeGIFAnimation(src []byte) (*Animation, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, errors.New("gif has no frames")
+	}
+	anim := &Animation{LoopCount: g.LoopCount, Format: "gif"}
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	for i, f := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var prev *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			prev = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, f.Bounds(), f, f.Bounds().Min, draw.Over)
+		anim.Frames = append(anim.Frames, cloneRGBA(canvas))
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i] * 10
+		}
+		anim.Delays = append(anim.Delays, delay)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, f.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	}
+	return anim, nil
+}
+
+// encodeGIFAnimation writes full frames, each quantized to its own local
+// palette. Every frame is disposed to background, so transparent pixels of a
+// frame never show the previous one.
+func encodeGIFAnimation(w io.Writer, anim *Animation) error {
+	g := &gif.GIF{LoopCount: anim.LoopCount}
+	for i, f := range anim.Frames {
+		pal, transparent := gifPalette(framePalette(f))
+		lookup := make(map[uint32]uint8)
+		b := f.Bounds()
+		pm := image.NewPaletted(b, pal)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := f.RGBAAt(x, y)
+				if c.A < 0x80 {
+					pm.SetColorIndex(x, y, transparent)
+					continue
+				}
+				// premultiplied, so undo alpha before the opaque palette lookup
+				if c.A != 0xff {
+					c = color.RGBA{
+						R: uint8(uint32(c.R) * 0xff / uint32(c.A)),
+						G: uint8(uint32(c.G) * 0xff / uint32(c.A)),
+						B: uint8(uint32(c.B) * 0xff / uint32(c.A)),
+						A: 0xff,
+					}
+				}
+				key := uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+				idx, ok := lookup[key]
+				if !ok {
+					idx = uint8(pal.Index(c))
+					lookup[key] = idx
+				}
+				pm.SetColorIndex(x, y, idx)
+			}
+		}
+		g.Image = append(g.Image, pm)
+		g.Delay = append(g.Delay, anim.Delays[i]/10)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// framePalette returns the opaque colors of a frame if there are at most 255
+// of them, else a median cut palette of 255 colors.
+func framePalette(f *image.RGBA) color.Palette {
+	seen := make(map[color.NRGBA]bool)
+	var pal color.Palette
+	b := f.Bounds()
+	for y := b.Min.Y; y < b.Max.Y && len(pal) <= 255; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(f.RGBAAt(x, y)).(color.NRGBA)
+			if c.A < 0x80 {
+				continue
+			}
+			c.A = 0xff
+			if !seen[c] {
+				seen[c] = true
+				pal = append(pal, c)
+			}
+		}
+	}
+	if len(pal) <= 255 {
+		return pal
+	}
+	pal = pal[:0]
+	for _, c := range ExtractPalette(f, 255) {
+		pal = append(pal, color.NRGBA{R: uint8(c[0]), G: uint8(c[1]), B: uint8(c[2]), A: 0xff})
+	}
+	return pal
+}
+
+// gifPalette returns an opaque copy of the palette with one extra transparent
+// entry, replacing the last color if the palette is already full.
+func gifPalette(src color.Palette) (color.Palette, uint8) {
+	pal := make(color.Palette, 0, 256)
+	for _, c := range src {
+		if _, _, _, a := c.RGBA(); a == 0xffff {
+			pal = append(pal, c)
+		}
+	}
+	if len(pal) == 0 {
+		pal = append(pal, color.Black, color.White)
+	}
+	if len(pal) > 255 {
+		pal = pal[:255]
+	}
+	pal = append(pal, color.Transparent)
+	return pal, uint8(len(pal) - 1)
+}
+
+// gifFrameInfo walks the GIF block structure without decoding any pixels and
+// returns the number of frames and the total duration in milliseconds.
+func gifFrameInfo(r io.Reader) (int, int, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, 13)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return 0, 0, err
+	}
+	if string(hdr[:3]) != "GIF" {
+		return 0, 0, errors.New("not a gif")
+	}
+	if hdr[10]&0x80 != 0 {
+		if _, err := br.Discard(3 << (hdr[10]&7 + 1)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	frames, duration := 0, 0
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch b {
+		case 0x21: // extension
+			label, err := br.ReadByte()
+			if err != nil {
+				return 0, 0, err
+			}
+			if label == 0xf9 {
+				gce := make([]byte, 5)
+				if _, err := io.ReadFull(br, gce); err != nil {
+					return 0, 0, err
+				}
+				duration += (int(gce[2]) | int(gce[3])<<8) * 10
+			}
+			if err := skipGIFSubBlocks(br); err != nil {
+				return 0, 0, err
+			}
+		case 0x2c: // image descriptor
+			desc := make([]byte, 9)
+			if _, err := io.ReadFull(br, desc); err != nil {
+				return 0, 0, err
+			}
+			if desc[8]&0x80 != 0 {
+				if _, err := br.Discard(3 << (desc[8]&7 + 1)); err != nil {
+					return 0, 0, err
+				}
+			}
+			// LZW minimum code size
+			if _, err := br.ReadByte(); err != nil {
+				return 0, 0, err
+			}
+			if err := skipGIFSubBlocks(br); err != nil {
+				return 0, 0, err
+			}
+			frames++
+		case 0x3b: // trailer
+			return frames, duration, nil
+		default:
+			return 0, 0, errors.New("gif: unknown block")
+		}
+	}
+}
+
+func skipGIFSubBlocks(br *bufio.Reader) error {
+	for {
+		n, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(n)); err != nil {
+			return err
+		}
+	}
+}
+
+const (
+	webpAnimationFlag = 1 << 1
+	webpXMPFlag       = 1 << 2
+	webpEXIFFlag      = 1 << 3
+	webpAlphaFlag     = 1 << 4
+)
+
+func isAnimatedWebP(src []byte) bool {
+	for _, c := range riffChunks(src) {
+		if c.ID == "VP8X" && len(c.Data) >= 10 {
+			return c.Data[0]&webpAnimationFlag != 0
+		}
+	}
+	return false
+}
+
+func webpFrameInfo(src []byte) (int, int) {
+	frames, duration := 0, 0
+	for _, c := range riffChunks(src) {
+		if c.ID == "ANMF" && len(c.Data) >= 16 {
+			frames++
+			duration += int(uint24(c.Data[12:]))
+		}
+	}
+	return frames, duration
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+func appendRIFFChunk(dst []byte, id string, data []byte) []byte {
+	hdr := make([]byte, 8)
+	copy(hdr, id)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(data)))
+	dst = append(dst, hdr...)
+	dst = append(dst, data...)
+	if len(data)&1 != 0 {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+// decodeWebPAnimation decodes every ANMF frame by wrapping its bitstream
+// into a standalone still WebP, then composes the frames on the canvas.
+func decodeWebPAnimation(src []byte) (*Animation, error) {
+	var canvas *image.RGBA
+	anim := &Animation{Format: "png"}
+	for _, c := range riffChunks(src) {
+		switch c.ID {
+		case "VP8X":
+			if len(c.Data) < 10 {
+				return nil, errors.New("webp: invalid VP8X")
+			}
+			canvas = image.NewRGBA(image.Rect(0, 0, int(uint24(c.Data[4:]))+1, int(uint24(c.Data[7:]))+1))
+		case "ANIM":
+			if len(c.Data) >= 6 {
+				anim.LoopCount = loopCount(int(binary.LittleEndian.Uint16(c.Data[4:])))
+			}
+		case "ANMF":
+			if canvas == nil || len(c.Data) < 16 {
+				return nil, errors.New("webp: invalid ANMF")
+			}
+			fimg, err := decodeWebPFrame(c.Data[16:], uint24(c.Data[6:]), uint24(c.Data[9:]))
+			if err != nil {
+				return nil, err
+			}
+			offset := image.Pt(int(uint24(c.Data[0:]))*2, int(uint24(c.Data[3:]))*2)
+			rect := fimg.Bounds().Sub(fimg.Bounds().Min).Add(offset)
+			flags := c.Data[15]
+			op := draw.Over
+			if flags&0x02 != 0 {
+				op = draw.Src
+			}
+			draw.Draw(canvas, rect, fimg, fimg.Bounds().Min, op)
+			anim.Frames = append(anim.Frames, cloneRGBA(canvas))
+			anim.Delays = append(anim.Delays, int(uint24(c.Data[12:])))
+			if flags&0x01 != 0 {
+				draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+			}
+		}
+	}
+	if len(anim.Frames) == 0 {
+		return nil, errors.New("webp: no frames")
+	}
+	return anim, nil
+}
+
+func decodeWebPFrame(data []byte, wMinusOne, hMinusOne uint32) (image.Image, error) {
+	body := []byte("WEBP")
+	var alph, bitstream riffChunk
+	for pos := 0; pos+8 <= len(data); {
+		n := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if n < 0 || pos+8+n > len(data) {
+			break
+		}
+		c := riffChunk{ID: string(data[pos : pos+4]), Data: data[pos+8 : pos+8+n]}
+		switch c.ID {
+		case "ALPH":
+			alph = c
+		case "VP8 ", "VP8L":
+			bitstream = c
+		}
+		pos += 8 + n + n&1
+	}
+	if bitstream.ID == "" {
+		return nil, errors.New("webp: frame without bitstream")
+	}
+	if alph.ID != "" && bitstream.ID == "VP8 " {
+		vp8x := make([]byte, 10)
+		vp8x[0] = webpAlphaFlag
+		putUint24(vp8x[4:], wMinusOne)
+		putUint24(vp8x[7:], hMinusOne)
+		body = appendRIFFChunk(body, "VP8X", vp8x)
+		body = appendRIFFChunk(body, "ALPH", alph.Data)
+	}
+	body = appendRIFFChunk(body, bitstream.ID, bitstream.Data)
+	file := appendRIFFChunk(nil, "RIFF", body)
+	return webp.Decode(bytes.NewReader(file))
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+const (
+	apngDisposeNone       = 0
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+	apngBlendSource       = 0
+)
+
+type pngChunk struct {
+	Type string
+	Data []byte
+}
+
+func pngChunks(src []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(src, pngSignature) {
+		return nil, errors.New("not a png")
+	}
+	var chunks []pngChunk
+	for pos := len(pngSignature); pos+12 <= len(src); {
+		n := int(binary.BigEndian.Uint32(src[pos:]))
+		if n < 0 || pos+12+n > len(src) {
+			return nil, errors.New("png: truncated chunk")
+		}
+		c := pngChunk{Type: string(src[pos+4 : pos+8]), Data: src[pos+8 : pos+8+n]}
+		chunks = append(chunks, c)
+		if c.Type == "IEND" {
+			break
+		}
+		pos += 12 + n
+	}
+	return chunks, nil
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	io.WriteString(crc, typ)
+	crc.Write(data)
+	io.WriteString(w, typ)
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// isAPNG reports whether a PNG stream carries an animation control chunk.
+func isAPNG(src []byte) bool {
+	chunks, err := pngChunks(src)
+	if err != nil {
+		return false
+	}
+	for _, c := range chunks {
+		switch c.Type {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+	}
+	return false
+}
+
+// apngFrameInfo returns the number of frames and total duration in
+// milliseconds of an APNG stream.
+func apngFrameInfo(src []byte) (int, int) {
+	chunks, err := pngChunks(src)
+	if err != nil {
+		return 0, 0
+	}
+	frames, duration := 0, 0
+	for _, c := range chunks {
+		if c.Type == "fcTL" && len(c.Data) >= 26 {
+			frames++
+			duration += apngDelay(c.Data)
+		}
+	}
+	return frames, duration
+}
+
+func apngDelay(fctl []byte) int {
+	num := int(binary.BigEndian.Uint16(fctl[20:]))
+	den := int(binary.BigEndian.Uint16(fctl[22:]))
+	if den == 0 {
+		den = 100
+	}
+	return num * 1000 / den
+}
+
+var errAPNGFrameBounds = errors.New("apng: frame outside the canvas")
+
+type apngFrame struct {
+	fctl []byte
+	data [][]byte
+}
+
+// decodeAPNGAnimation decodes every frame of an APNG by wrapping its image
+// data into a standalone PNG stream, then composes the frames on the canvas.
+func decodeAPNGAnimation(src []byte) (*Animation, error) {
+	chunks, err := pngChunks(src)
+	if err != nil {
+		return nil, err
+	}
+	var ihdr []byte
+	var shared []pngChunk
+	var frames []*apngFrame
+	var cur *apngFrame
+	plays := 0
+	for _, c := range chunks {
+		switch c.Type {
+		case "IHDR":
+			ihdr = c.Data
+		case "PLTE", "tRNS":
+			shared = append(shared, c)
+		case "acTL":
+			if len(c.Data) >= 8 {
+				plays = int(binary.BigEndian.Uint32(c.Data[4:]))
+			}
+		case "fcTL":
+			if len(c.Data) < 26 {
+				return nil, errors.New("apng: invalid fcTL")
+			}
+			cur = &apngFrame{fctl: c.Data}
+			frames = append(frames, cur)
+		case "IDAT":
+			// the default image is only part of the animation if an fcTL precedes it
+			if cur != nil {
+				cur.data = append(cur.data, c.Data)
+			}
+		case "fdAT":
+			if cur != nil && len(c.Data) > 4 {
+				cur.data = append(cur.data, c.Data[4:])
+			}
+		}
+	}
+	if len(ihdr) != 13 || len(frames) == 0 {
+		return nil, errors.New("apng: no frames")
+	}
+
+	anim := &Animation{Format: "png", LoopCount: loopCount(plays)}
+	canvas := image.NewRGBA(image.Rect(0, 0,
+		int(binary.BigEndian.Uint32(ihdr[0:])), int(binary.BigEndian.Uint32(ihdr[4:]))))
+	for i, f := range frames {
+		w := binary.BigEndian.Uint32(f.fctl[4:])
+		h := binary.BigEndian.Uint32(f.fctl[8:])
+		fx := binary.BigEndian.Uint32(f.fctl[12:])
+		fy := binary.BigEndian.Uint32(f.fctl[16:])
+		// frames must be non-empty and inside the canvas, checked before
+		// decoding them allocates their size
+		if w == 0 || h == 0 || uint64(fx)+uint64(w) > uint64(canvas.Rect.Dx()) || uint64(fy)+uint64(h) > uint64(canvas.Rect.Dy()) {
+			return nil, errAPNGFrameBounds
+		}
+		ox, oy := int(fx), int(fy)
+		dispose := f.fctl[24]
+		blend := f.fctl[25]
+
+		var b bytes.Buffer
+		b.Write(pngSignature)
+		fihdr := append([]byte(nil), ihdr...)
+		binary.BigEndian.PutUint32(fihdr[0:], w)
+		binary.BigEndian.PutUint32(fihdr[4:], h)
+		writePNGChunk(&b, "IHDR", fihdr)
+		for _, c := range shared {
+			writePNGChunk(&b, c.Type, c.Data)
+		}
+		writePNGChunk(&b, "IDAT", bytes.Join(f.data, nil))
+		writePNGChunk(&b, "IEND", nil)
+		fimg, err := png.Decode(&b)
+		if err != nil {
+			return nil, err
+		}
+
+		rect := fimg.Bounds().Add(image.Pt(ox, oy))
+		if i == 0 && dispose == apngDisposePrevious {
+			dispose = apngDisposeBackground
+		}
+		var prev *image.RGBA
+		if dispose == apngDisposePrevious {
+			prev = cloneRGBA(canvas)
+		}
+		op := draw.Over
+		if blend == apngBlendSource {
+			op = draw.Src
+		}
+		draw.Draw(canvas, rect, fimg, fimg.Bounds().Min, op)
+		anim.Frames = append(anim.Frames, cloneRGBA(canvas))
+		anim.Delays = append(anim.Delays, apngDelay(f.fctl))
+
+		switch dispose {
+		case apngDisposeBackground:
+			draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			canvas = prev
+		}
+	}
+	return anim, nil
+}
+
+// encodeAPNG writes full RGBA frames, each replacing the previous one.
+func encodeAPNG(w io.Writer, anim *Animation) error {
+	if len(anim.Frames) == 0 {
+		return errors.New("apng: no frames")
+	}
+	b := anim.Frames[0].Bounds()
+	var out bytes.Buffer
+	out.Write(pngSignature)
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(b.Dy()))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // truecolor with alpha
+	writePNGChunk(&out, "IHDR", ihdr)
+
+	plays := 0
+	if anim.LoopCount < 0 {
+		plays = 1
+	} else if anim.LoopCount > 0 {
+		plays = anim.LoopCount + 1
+	}
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(anim.Frames)))
+	binary.BigEndian.PutUint32(actl[4:], uint32(plays))
+	writePNGChunk(&out, "acTL", actl)
+
+	seq := uint32(0)
+	for i, f := range anim.Frames {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(b.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(b.Dy()))
+		num, den := anim.Delays[i], 1000
+		if num > 0xffff {
+			num, den = num/10, 100
+		}
+		binary.BigEndian.PutUint16(fctl[20:], uint16(num))
+		binary.BigEndian.PutUint16(fctl[22:], uint16(den))
+		fctl[24] = apngDisposeNone
+		fctl[25] = apngBlendSource
+		writePNGChunk(&out, "fcTL", fctl)
+		seq++
+
+		data, err := pngImageData(f)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			writePNGChunk(&out, "IDAT", data)
+			continue
+		}
+		fdat := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, seq)
+		writePNGChunk(&out, "fdAT", append(fdat, data...))
+		seq++
+	}
+	writePNGChunk(&out, "IEND", nil)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// pngImageData returns the zlib compressed, filtered 8-bit RGBA scanlines of
+// an image. Every row uses the filter that minimizes the sum of absolute
+// differences, like the standard library encoder does.
+func pngImageData(img *image.RGBA) ([]byte, error) {
+	b := img.Bounds()
+	stride := b.Dx() * 4
+	prev := make([]byte, stride)
+	cur := make([]byte, stride)
+	filtered := make([][]byte, 5)
+	for i := range filtered {
+		filtered[i] = make([]byte, stride)
+	}
+
+	var out bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&out, zlib.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := img.RGBAAt(b.Min.X+x, y)
+			if c.A != 0 && c.A != 0xff {
+				c.R = uint8(uint32(c.R) * 0xff / uint32(c.A))
+				c.G = uint8(uint32(c.G) * 0xff / uint32(c.A))
+				c.B = uint8(uint32(c.B) * 0xff / uint32(c.A))
+			}
+			cur[x*4], cur[x*4+1], cur[x*4+2], cur[x*4+3] = c.R, c.G, c.B, c.A
+		}
+
+		best, bestSum := 0, -1
+		for ft := 0; ft < 5; ft++ {
+			sum := 0
+			for i := 0; i < stride; i++ {
+				var a, up, ul byte
+				if i >= 4 {
+					a, ul = cur[i-4], prev[i-4]
+				}
+				up = prev[i]
+				var v byte
+				switch ft {
+				case 0:
+					v = cur[i]
+				case 1:
+					v = cur[i] - a
+				case 2:
+					v = cur[i] - up
+				case 3:
+					v = cur[i] - byte((int(a)+int(up))/2)
+				case 4:
+					v = cur[i] - paeth(a, up, ul)
+				}
+				filtered[ft][i] = v
+				if v < 128 {
+					sum += int(v)
+				} else {
+					sum += 256 - int(v)
+				}
+			}
+			if bestSum < 0 || sum < bestSum {
+				best, bestSum = ft, sum
+			}
+		}
+		zw.Write([]byte{byte(best)})
+		zw.Write(filtered[best])
+		prev, cur = cur, prev
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
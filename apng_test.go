@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+)
+
+// apngTestStream returns an APNG with a w x h canvas and one frame of the
+// given size and offset, whose pixels are transparent.
+func apngTestStream(w, h, fw, fh, fx, fy uint32) []byte {
+	var b bytes.Buffer
+	b.Write(pngSignature)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], w)
+	binary.BigEndian.PutUint32(ihdr[4:], h)
+	ihdr[8], ihdr[9] = 8, 6 // 8-bit RGBA
+	writePNGChunk(&b, "IHDR", ihdr)
+	writePNGChunk(&b, "acTL", []byte{0, 0, 0, 1, 0, 0, 0, 0})
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[4:], fw)
+	binary.BigEndian.PutUint32(fctl[8:], fh)
+	binary.BigEndian.PutUint32(fctl[12:], fx)
+	binary.BigEndian.PutUint32(fctl[16:], fy)
+	writePNGChunk(&b, "fcTL", fctl)
+	var data bytes.Buffer
+	zw := zlib.NewWriter(&data)
+	zw.Write(make([]byte, int(h)*(1+4*int(w))))
+	zw.Close()
+	writePNGChunk(&b, "IDAT", data.Bytes())
+	writePNGChunk(&b, "IEND", nil)
+	return b.Bytes()
+}
+
+func TestAPNGFrameBounds(t *testing.T) {
+	if _, err := decodeAPNGAnimation(apngTestStream(4, 4, 4, 4, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range [][4]uint32{
+		{1 << 20, 1 << 20, 0, 0},
+		{0, 4, 0, 0},
+		{4, 0, 0, 0},
+		{2, 2, 3, 0},
+		{2, 2, 0, 3},
+		{2, 2, 1<<32 - 1, 0},
+	} {
+		if _, err := decodeAPNGAnimation(apngTestStream(4, 4, f[0], f[1], f[2], f[3])); err != errAPNGFrameBounds {
+			t.Errorf("frame %v: %v", f, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// AssetMeta holds information derived from a stored image. It is persisted as
+// JSON in the M directory under the image hash, unlike MetaDef which is read
+// from the image file itself and only cached in memory.
+type AssetMeta struct {
+	Placeholder string   `json:"placeholder,omitempty"`
+	Color       []uint32 `json:"color,omitempty"`
+	// DHash is the hex encoded difference hash, see DHash
+	DHash string `json:"dhash,omitempty"`
+	// Filter overrides the resampling filter of the texture sizes
+	Filter string `json:"filter,omitempty"`
+	// Quality overrides the JPEG quality of the textures
+	Quality int `json:"quality,omitempty"`
+	// ICCProfile is the name of the color profile embedded in the upload
+	ICCProfile string `json:"icc_profile,omitempty"`
+	// Palettes are keyed by the number of requested colors
+	Palettes map[string][][]uint32 `json:"palettes,omitempty"`
+	// Sources are the images a generated image was made from, Derived the
+	// images generated from this one
+	Sources []string `json:"sources,omitempty"`
+	Derived []string `json:"derived,omitempty"`
+	// Atlas holds the placement of every source of an atlas
+	Atlas map[string]AtlasRect `json:"atlas,omitempty"`
+	// Cubemaps are the face hashes of a panorama in CubemapFaces order, keyed
+	// by face size
+	Cubemaps map[string][]string `json:"cubemaps,omitempty"`
+	// NormalMaps are keyed by strength, with an "i" suffix when inverted
+	NormalMaps map[string]string `json:"normalmaps,omitempty"`
+	// NormalMap marks generated normal maps, which are scaled as vectors and
+	// stored losslessly
+	NormalMap bool `json:"normalmap,omitempty"`
+	// Crops are the smart crops keyed by reduced aspect ratio, e.g. "16:9"
+	Crops map[string]CropRect `json:"crops,omitempty"`
+}
+
+// LoadAssetMeta returns the stored metadata of an image, or an empty
+// AssetMeta if nothing has been stored yet.
+func (x *RequestsHandler) LoadAssetMeta(ID string) (*AssetMeta, error) {
+	meta := new(AssetMeta)
+	data, err := ioutil.ReadFile(x.ImPathM + ID)
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// UpdateAssetMeta applies fn to the stored metadata of an image and writes
+// the result back. Updates are serialized, so concurrent writers of different
+// fields do not overwrite each other.
+func (x *RequestsHandler) UpdateAssetMeta(ID string, fn func(*AssetMeta)) (*AssetMeta, error) {
+	x.MetaMutex.Lock()
+	defer x.MetaMutex.Unlock()
+
+	meta, err := x.LoadAssetMeta(ID)
+	if err != nil {
+		return nil, err
+	}
+	fn(meta)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err = x.SaveWriteToFile(x.ImPathM+ID, data); err != nil {
+		return nil, err
+	}
+	x.forgetMeta(ID)
+	return meta, nil
+}
+
+// forgetMeta drops the cached MetaDefs of an image and of everything served
+// for it, as they carry its placeholder and color. Their keys are derived
+// from the hash, so nothing has to be searched.
+func (x *RequestsHandler) forgetMeta(ID string) {
+	x.ImageMapF.Remove(ID)
+	for rs, c := range x.ImageMapS {
+		c.Remove(ID)
+		x.ImageMapP.Remove(rs + "/" + ID)
+		x.ImageMapKTX2.Remove(rs + "/" + ID)
+	}
+	x.ImageMapP.Remove(posterFull + "/" + ID)
+	for _, mode := range mipModes {
+		for level := 0; level <= maxMipLevel; level++ {
+			x.ImageMapMip.Remove(mode + "/" + strconv.Itoa(level) + "/" + ID)
+		}
+	}
+	// crops come in any size, their keys are indexed by image
+	for _, key := range x.CropKeys.take(ID) {
+		x.ImageMapCrop.Remove(key)
+	}
+}
+
+// keyIndex lists cache keys by image, for caches whose keys can't be derived
+// from the image hash alone.
+type keyIndex struct {
+	mu   sync.Mutex
+	keys map[string]map[string]bool
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{keys: make(map[string]map[string]bool)}
+}
+
+func (ix *keyIndex) add(ID, key string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.keys[ID] == nil {
+		ix.keys[ID] = make(map[string]bool)
+	}
+	ix.keys[ID][key] = true
+}
+
+func (ix *keyIndex) remove(ID, key string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	delete(ix.keys[ID], key)
+	if len(ix.keys[ID]) == 0 {
+		delete(ix.keys, ID)
+	}
+}
+
+// take returns the keys of an image and forgets them.
+func (ix *keyIndex) take(ID string) []string {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	keys := make([]string, 0, len(ix.keys[ID]))
+	for k := range ix.keys[ID] {
+		keys = append(keys, k)
+	}
+	delete(ix.keys, ID)
+	return keys
+}
+
+// AddDerived records an image generated from a stored image.
+func (x *RequestsHandler) AddDerived(ID string, derived string) error {
+	_, err := x.UpdateAssetMeta(ID, func(m *AssetMeta) { m.addDerived(derived) })
+	return err
+}
+
+func (m *AssetMeta) addDerived(derived string) {
+	for _, d := range m.Derived {
+		if d == derived {
+			return
+		}
+	}
+	m.Derived = append(m.Derived, derived)
+}
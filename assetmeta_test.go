@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func TestForgetMeta(t *testing.T) {
+	x := newTestHandler(t)
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, photoTestImage(120, 80)); err != nil {
+		t.Fatal(err)
+	}
+	err, ID := x.ProcessImage(enc.Bytes(), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both crops share the stored 1:1 rect, so the second doesn't update the metadata
+	for _, w := range []int{10, 20} {
+		if _, fpath := x.presentSmartCrop(&ID, w, w); fpath == nil {
+			t.Fatalf("no crop of width %d", w)
+		}
+	}
+	rs := x.Tprecalcs[0]
+	x.ImageMapMip.Add(mipResize+"/3/"+ID, &MetaDef{})
+	x.ImageMapKTX2.Add(rs+"/"+ID, &MetaDef{})
+	x.ImageMapP.Add(posterFull+"/"+ID, &MetaDef{})
+	x.ImageMapMip.Add(mipResize+"/3/other", &MetaDef{})
+	if n := len(x.CropKeys.keys[ID]); n != 2 {
+		t.Fatalf("%d crop keys indexed, want 2", n)
+	}
+
+	if _, err = x.UpdateAssetMeta(ID, func(m *AssetMeta) {}); err != nil {
+		t.Fatal(err)
+	}
+	if x.ImageMapCrop.Len() != 0 || len(x.CropKeys.keys) != 0 {
+		t.Errorf("crops kept: %v, index %v", x.ImageMapCrop.Keys(), x.CropKeys.keys)
+	}
+	for _, k := range []string{mipResize + "/3/" + ID, rs + "/" + ID, posterFull + "/" + ID} {
+		if x.ImageMapMip.Contains(k) || x.ImageMapKTX2.Contains(k) || x.ImageMapP.Contains(k) {
+			t.Errorf("%s kept", k)
+		}
+	}
+	if !x.ImageMapMip.Contains(mipResize + "/3/other") {
+		t.Error("entry of another image dropped")
+	}
+
+	// evicted crops leave the index
+	if _, fpath := x.presentSmartCrop(&ID, 30, 10); fpath == nil {
+		t.Fatal("no crop")
+	}
+	x.ImageMapCrop.Remove(cropKey(ID, 30, 10))
+	if len(x.CropKeys.keys) != 0 {
+		t.Errorf("evicted crop indexed: %v", x.CropKeys.keys)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"regexp"
+	"sort"
+)
+
+const (
+	defaultAtlasSize    = 2048
+	maxAtlasSize        = 8192
+	defaultAtlasPadding = 2
+	maxAtlasPadding     = 64
+	maxAtlasImages      = 1024
+)
+
+var assetIDRe = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// errAtlasSize is returned when the images do not fit into the atlas.
+var errAtlasSize = errors.New("atlas: images do not fit into the maximum size")
+
+type AtlasRequest struct {
+	Images  []string `json:"images"`
+	MaxSize int      `json:"max_size"`
+	// Padding around every image, filled by extending its edges so texture
+	// filtering does not bleed neighbors in
+	Padding *int `json:"padding"`
+}
+
+// AtlasRect is the placement of one image in an atlas in pixels and in UV
+// coordinates with the origin in the top left corner.
+type AtlasRect struct {
+	X  int     `json:"x"`
+	Y  int     `json:"y"`
+	W  int     `json:"w"`
+	H  int     `json:"h"`
+	U0 float64 `json:"u0"`
+	V0 float64 `json:"v0"`
+	U1 float64 `json:"u1"`
+	V1 float64 `json:"v1"`
+}
+
+type AtlasResponse struct {
+	Hash   string               `json:"hash"`
+	Width  int                  `json:"width"`
+	Height int                  `json:"height"`
+	Rects  map[string]AtlasRect `json:"rects"`
+}
+
+// maxRectsPacker places rectangles with the MaxRects best short side fit
+// heuristic.
+type maxRectsPacker struct {
+	free []image.Rectangle
+}
+
+func newMaxRectsPacker(w, h int) *maxRectsPacker {
+	return &maxRectsPacker{free: []image.Rectangle{image.Rect(0, 0, w, h)}}
+}
+
+func (p *maxRectsPacker) insert(w, h int) (image.Rectangle, bool) {
+	best, bestShort, bestLong := -1, 0, 0
+	for i, f := range p.free {
+		if f.Dx() < w || f.Dy() < h {
+			continue
+		}
+		short, long := f.Dx()-w, f.Dy()-h
+		if short > long {
+			short, long = long, short
+		}
+		if best < 0 || short < bestShort || short == bestShort && long < bestLong {
+			best, bestShort, bestLong = i, short, long
+		}
+	}
+	if best < 0 {
+		return image.Rectangle{}, false
+	}
+	placed := image.Rect(0, 0, w, h).Add(p.free[best].Min)
+
+	var free []image.Rectangle
+	for _, f := range p.free {
+		if !f.Overlaps(placed) {
+			free = append(free, f)
+			continue
+		}
+		if placed.Min.X > f.Min.X {
+			free = append(free, image.Rect(f.Min.X, f.Min.Y, placed.Min.X, f.Max.Y))
+		}
+		if placed.Max.X < f.Max.X {
+			free = append(free, image.Rect(placed.Max.X, f.Min.Y, f.Max.X, f.Max.Y))
+		}
+		if placed.Min.Y > f.Min.Y {
+			free = append(free, image.Rect(f.Min.X, f.Min.Y, f.Max.X, placed.Min.Y))
+		}
+		if placed.Max.Y < f.Max.Y {
+			free = append(free, image.Rect(f.Min.X, placed.Max.Y, f.Max.X, f.Max.Y))
+		}
+	}
+	// drop free rectangles contained in others
+	p.free = make([]image.Rectangle, 0, len(free))
+	for i, a := range free {
+		contained := false
+		for j, b := range free {
+			if i != j && a.In(b) && (a != b || i > j) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			p.free = append(p.free, a)
+		}
+	}
+	return placed, true
+}
+
+// packAtlas finds the smallest power-of-two atlas up to maxSize holding all
+// sizes and returns it with the placements in the order of sizes.
+func packAtlas(sizes []image.Point, maxSize int) (image.Point, []image.Rectangle, error) {
+	order := make([]int, len(sizes))
+	area := 0
+	for i, s := range sizes {
+		if s.X > maxSize || s.Y > maxSize {
+			return image.Point{}, nil, errAtlasSize
+		}
+		order[i] = i
+		area += s.X * s.Y
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := sizes[order[i]], sizes[order[j]]
+		if ma, mb := maxInt(a.X, a.Y), maxInt(b.X, b.Y); ma != mb {
+			return ma > mb
+		}
+		return a.X*a.Y > b.X*b.Y
+	})
+
+	w, h := 1, 1
+	for w*h < area {
+		if w > h {
+			h <<= 1
+		} else {
+			w <<= 1
+		}
+	}
+	for w <= maxSize && h <= maxSize {
+		p := newMaxRectsPacker(w, h)
+		rects := make([]image.Rectangle, len(sizes))
+		fits := true
+		for _, i := range order {
+			if rects[i], fits = p.insert(sizes[i].X, sizes[i].Y); !fits {
+				break
+			}
+		}
+		if fits {
+			return image.Pt(w, h), rects, nil
+		}
+		if w > h {
+			h <<= 1
+		} else {
+			w <<= 1
+		}
+	}
+	return image.Point{}, nil, errAtlasSize
+}
+
+// drawExtruded draws img into r of dst and repeats its edge pixels into the
+// surrounding padding.
+func drawExtruded(dst *image.RGBA, r image.Rectangle, img image.Image, pad int) {
+	sb := img.Bounds()
+	draw.Draw(dst, r, img, sb.Min, draw.Src)
+	for i := 1; i <= pad; i++ {
+		// left and right columns, then top and bottom rows including corners
+		draw.Draw(dst, image.Rect(r.Min.X-i, r.Min.Y, r.Min.X-i+1, r.Max.Y), dst, image.Pt(r.Min.X, r.Min.Y), draw.Src)
+		draw.Draw(dst, image.Rect(r.Max.X+i-1, r.Min.Y, r.Max.X+i, r.Max.Y), dst, image.Pt(r.Max.X-1, r.Min.Y), draw.Src)
+	}
+	for i := 1; i <= pad; i++ {
+		draw.Draw(dst, image.Rect(r.Min.X-pad, r.Min.Y-i, r.Max.X+pad, r.Min.Y-i+1), dst, image.Pt(r.Min.X-pad, r.Min.Y), draw.Src)
+		draw.Draw(dst, image.Rect(r.Min.X-pad, r.Max.Y+i-1, r.Max.X+pad, r.Max.Y+i), dst, image.Pt(r.Min.X-pad, r.Max.Y-1), draw.Src)
+	}
+}
+
+// BuildAtlas packs stored images into one atlas and stores it like any other
+// image. The placements are kept in the asset metadata of the atlas and the
+// atlas is listed as derived in the metadata of every source.
+func (x *RequestsHandler) BuildAtlas(req *AtlasRequest) (*AtlasResponse, error) {
+	pad := defaultAtlasPadding
+	if req.Padding != nil {
+		pad = *req.Padding
+	}
+	maxSize := req.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultAtlasSize
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, ID := range req.Images {
+		if !seen[ID] {
+			seen[ID] = true
+			ids = append(ids, ID)
+		}
+	}
+	imgs := make([]image.Image, len(ids))
+	sizes := make([]image.Point, len(ids))
+	for i, ID := range ids {
+		img, err := x.LoadFull(ID)
+		if err != nil {
+			return nil, err
+		}
+		imgs[i] = img
+		sizes[i] = img.Bounds().Size().Add(image.Pt(2*pad, 2*pad))
+	}
+
+	size, rects, err := packAtlas(sizes, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	atlas := image.NewRGBA(image.Rectangle{Max: size})
+	res := &AtlasResponse{Width: size.X, Height: size.Y, Rects: make(map[string]AtlasRect)}
+	for i, ID := range ids {
+		r := rects[i].Inset(pad)
+		drawExtruded(atlas, r, imgs[i], pad)
+		res.Rects[ID] = AtlasRect{
+			X: r.Min.X, Y: r.Min.Y, W: r.Dx(), H: r.Dy(),
+			U0: float64(r.Min.X) / float64(size.X), V0: float64(r.Min.Y) / float64(size.Y),
+			U1: float64(r.Max.X) / float64(size.X), V1: float64(r.Max.Y) / float64(size.Y),
+		}
+	}
+
+	err, res.Hash = x.WriteToF(atlas)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = x.WriteImageMeta(res.Hash, atlas); err != nil {
+		return nil, err
+	}
+	if _, err = x.UpdateAssetMeta(res.Hash, func(m *AssetMeta) {
+		m.Atlas = res.Rects
+		m.Sources = ids
+	}); err != nil {
+		return nil, err
+	}
+	for _, ID := range ids {
+		if err = x.AddDerived(ID, res.Hash); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range x.Tprecalcs {
+		if err = x.WriteToScaled(res.Hash, atlas, v); err != nil {
+			return nil, err
+		}
+	}
+	L().Info("Atlas:", res.Hash)
+	return res, nil
+}
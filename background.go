@@ -0,0 +1,196 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/gift"
+	"github.com/oakmound/oak/v3/render"
+)
+
+const (
+	bgFitStretch = "stretch"
+	bgFitCover   = "cover"
+	bgFitContain = "contain"
+	bgFitTile    = "tile"
+	bgFitNone    = "none"
+)
+
+// bgFitModes are the ways a background image can be fitted into its frame:
+// stretch scales it to the frame size ignoring its aspect ratio, cover fills
+// the frame cutting off what sticks out, contain shows all of it leaving the
+// rest of the frame to the background color, tile repeats it unscaled and
+// none draws it once unscaled.
+var bgFitModes = []string{bgFitStretch, bgFitCover, bgFitContain, bgFitTile, bgFitNone}
+
+// bgAnchors map anchor names to the relative position of the image in the
+// frame. For tile it is where one of the tiles is placed.
+var bgAnchors = map[string][2]float64{
+	"center":      {0.5, 0.5},
+	"top":         {0.5, 0},
+	"bottom":      {0.5, 1},
+	"left":        {0, 0.5},
+	"right":       {1, 0.5},
+	"topleft":     {0, 0},
+	"topright":    {1, 0},
+	"bottomleft":  {0, 1},
+	"bottomright": {1, 1},
+}
+
+func isBGFit(mode string) bool {
+	for _, m := range bgFitModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// bgAnchor returns the anchor of a frame, centered if not set.
+func bgAnchor(frame *FrameDesc) [2]float64 {
+	if a, ok := bgAnchors[frame.BGAnchor]; ok {
+		return a
+	}
+	return bgAnchors["center"]
+}
+
+// anchorOffset returns the position of an image of size n in a frame of size
+// total, at the relative anchor position a. It is negative if the image is
+// larger than the frame.
+func anchorOffset(total, n int, a float64) int {
+	return int(math.Round(float64(total-n) * a))
+}
+
+// fitBackground draws a background image into a w x h canvas according to
+// the fit mode and anchor of the frame. Smart crops apply to stretch and
+// cover, where they replace the anchor.
+func (x *RequestsHandler) fitBackground(frame *FrameDesc, src image.Image, w, h int) (*image.RGBA, error) {
+	if insets, ok := cssSides(frame.BGSlice); ok {
+		return nineSlice(src, insets, w, h, frameFilter(frame)), nil
+	}
+	fit := frame.BGFit
+	if fit == "" {
+		fit = bgFitStretch
+	}
+	if frame.BGCrop == cropSmart && (fit == bgFitStretch || fit == bgFitCover) {
+		c, err := x.smartCrop(frame.BGimage, src, w, h)
+		if err != nil {
+			return nil, err
+		}
+		src, fit = cropImage(src, c), bgFitStretch
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sb := src.Bounds()
+	iw, ih := sb.Dx(), sb.Dy()
+	if iw == 0 || ih == 0 {
+		return dst, nil
+	}
+	anchor := bgAnchor(frame)
+	filter := frameFilter(frame)
+	place := func(img image.Image, ox, oy int) {
+		b := img.Bounds()
+		r := image.Rect(ox, oy, ox+b.Dx(), oy+b.Dy())
+		draw.Draw(dst, r, img, b.Min, draw.Over)
+	}
+
+	switch fit {
+	case bgFitStretch:
+		place(resampleLinear(src, w, h, filter), 0, 0)
+	case bgFitCover, bgFitContain:
+		scale := math.Max(float64(w)/float64(iw), float64(h)/float64(ih))
+		if fit == bgFitContain {
+			scale = math.Min(float64(w)/float64(iw), float64(h)/float64(ih))
+		}
+		sw := maxInt(1, int(math.Round(float64(iw)*scale)))
+		sh := maxInt(1, int(math.Round(float64(ih)*scale)))
+		place(resampleLinear(src, sw, sh, filter), anchorOffset(w, sw, anchor[0]), anchorOffset(h, sh, anchor[1]))
+	case bgFitTile:
+		ox := anchorOffset(w, iw, anchor[0]) % iw
+		oy := anchorOffset(h, ih, anchor[1]) % ih
+		if ox > 0 {
+			ox -= iw
+		}
+		if oy > 0 {
+			oy -= ih
+		}
+		for ty := oy; ty < h; ty += ih {
+			for tx := ox; tx < w; tx += iw {
+				place(src, tx, ty)
+			}
+		}
+	case bgFitNone:
+		place(src, anchorOffset(w, iw, anchor[0]), anchorOffset(h, ih, anchor[1]))
+	}
+	return dst, nil
+}
+
+// nineSlice scales an image to w x h keeping the corners given by the insets
+// at their size. Edges are only stretched along the frame side, the center in
+// both directions. Insets larger than the image are clamped, corners larger
+// than the frame are scaled down evenly.
+func nineSlice(src image.Image, insets [4]int, w, h int, filter gift.Resampling) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sb := src.Bounds()
+	iw, ih := sb.Dx(), sb.Dy()
+	t, r, b, l := insets[0], insets[1], insets[2], insets[3]
+	if l+r > iw {
+		l = l * iw / (l + r)
+		r = iw - l
+	}
+	if t+b > ih {
+		t = t * ih / (t + b)
+		b = ih - t
+	}
+	scale := 1.0
+	if l+r > w {
+		scale = float64(w) / float64(l+r)
+	}
+	if t+b > h {
+		scale = math.Min(scale, float64(h)/float64(t+b))
+	}
+	dl, dr := int(math.Round(float64(l)*scale)), int(math.Round(float64(r)*scale))
+	dt, db := int(math.Round(float64(t)*scale)), int(math.Round(float64(b)*scale))
+
+	sx := [4]int{0, l, iw - r, iw}
+	sy := [4]int{0, t, ih - b, ih}
+	dx := [4]int{0, dl, w - dr, w}
+	dy := [4]int{0, dt, h - db, h}
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			s := image.Rect(sx[col], sy[row], sx[col+1], sy[row+1]).Add(sb.Min)
+			d := image.Rect(dx[col], dy[row], dx[col+1], dy[row+1])
+			if s.Empty() || d.Empty() {
+				continue
+			}
+			part := cropImage(src, CropRect{X: s.Min.X - sb.Min.X, Y: s.Min.Y - sb.Min.Y, W: s.Dx(), H: s.Dy()})
+			if s.Dx() != d.Dx() || s.Dy() != d.Dy() {
+				part = resampleLinear(part, d.Dx(), d.Dy(), filter)
+			}
+			draw.Draw(dst, d, part, part.Bounds().Min, draw.Src)
+		}
+	}
+	return dst
+}
+
+// bgImage loads the background image of a frame, fitted into the frame and
+// with its opacity applied. It returns nil if the image is missing or broken.
+func (x *RequestsHandler) bgImage(frame *FrameDesc) *render.Sprite {
+	L().Debug("bgimage:", frame.BGimage)
+	if frame.Width <= 0 || frame.Height <= 0 || !fileExists(x.ImPathF+frame.BGimage) {
+		return nil
+	}
+	src, err := x.LoadFull(frame.BGimage)
+	if check_error(err) {
+		return nil
+	}
+	bg, err := x.fitBackground(frame, src, frame.Width, frame.Height)
+	if check_error(err) {
+		return nil
+	}
+	if frame.BGOpacity != nil && *frame.BGOpacity < 1 {
+		bg = fadeImage(bg, *frame.BGOpacity)
+	}
+	return render.NewSprite(0, 0, bg)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// backgroundTestImage is 4x4 with a differently colored 2x2 quadrant in each
+// corner, the bottom right one translucent.
+func backgroundTestImage() *image.NRGBA {
+	quadrants := [4]color.NRGBA{
+		{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 128},
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.SetNRGBA(x, y, quadrants[y/2*2+x/2])
+		}
+	}
+	return img
+}
+
+// checkGolden compares an image pixel by pixel with testdata/name, or
+// rewrites it with -update.
+func checkGolden(t *testing.T, name string, img image.Image) {
+	t.Helper()
+	fpath := filepath.Join("testdata", name)
+	if *updateGolden {
+		os.MkdirAll(filepath.Dir(fpath), os.ModePerm)
+		f, err := os.Create(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err = png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != want.Bounds() {
+		t.Fatalf("%s: size %v, want %v", name, img.Bounds(), want.Bounds())
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			got := color.NRGBAModel.Convert(img.At(x, y))
+			if w := color.NRGBAModel.Convert(want.At(x, y)); got != w {
+				t.Errorf("%s: pixel %d,%d is %v, want %v", name, x, y, got, w)
+			}
+		}
+	}
+}
+
+func TestFitBackground(t *testing.T) {
+	anchors := make([]string, 0, len(bgAnchors))
+	for a := range bgAnchors {
+		anchors = append(anchors, a)
+	}
+	sort.Strings(anchors)
+
+	x := new(RequestsHandler)
+	src := backgroundTestImage()
+	for _, fit := range bgFitModes {
+		for _, anchor := range anchors {
+			if fit == bgFitStretch && anchor != "center" {
+				// stretch fills the frame, the anchor doesn't apply
+				continue
+			}
+			frame := &FrameDesc{Width: 12, Height: 6, BGFit: fit, BGAnchor: anchor, Filter: "nearest"}
+			img, err := x.fitBackground(frame, src, frame.Width, frame.Height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, "background/"+fit+"_"+anchor+".png", img)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+)
+
+// TextureBucket defines a texture size, either by its pixel count or by the
+// length of its longer edge.
+type TextureBucket struct {
+	Name    string `yaml:"name" json:"name"`
+	Pixels  int    `yaml:"pixels,omitempty" json:"pixels,omitempty"`
+	MaxEdge int    `yaml:"max_edge,omitempty" json:"max_edge,omitempty"`
+	// Filter is the resampling filter used for downscaling, see
+	// resamplingFilters
+	Filter string `yaml:"filter,omitempty" json:"filter,omitempty"`
+}
+
+const defaultBucketFilter = "bilinear"
+
+// bucketManifest records the bucket definitions the stored textures were
+// made with, so changed buckets can be detected on startup.
+const bucketManifest = "buckets.json"
+
+var bucketNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// bucketReservedNames are directories of Imagepath not holding textures.
+// "tracks" is where the audio tracks are kept by default.
+var bucketReservedNames = map[string]bool{
+	posterFull: true, "M": true, "P": true, "svg": true, "mip": true, "ktx2": true, "crop": true, "tracks": true,
+}
+
+// subdirsOf returns the directories of dir holding any of the given paths,
+// e.g. the audio path configured below Imagepath.
+func subdirsOf(dir string, paths ...string) map[string]bool {
+	res := make(map[string]bool)
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return res
+	}
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(base, abs)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		res[strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]] = true
+	}
+	return res
+}
+
+// defaultTextureBuckets are the buckets used before they were configurable.
+func defaultTextureBuckets() []TextureBucket {
+	pixels := []int{1024, 4096, 9216, 25600, 65536, 193600, 577600, 1721344, 5062500, 14745600}
+	buckets := make([]TextureBucket, len(pixels))
+	for i, p := range pixels {
+		buckets[i] = TextureBucket{Name: "s" + strconv.Itoa(i), Pixels: p, Filter: defaultBucketFilter}
+	}
+	return buckets
+}
+
+func defaultTexturePrecalcs() []string {
+	return []string{"s2", "s3", "s4", "s5", "s6"}
+}
+
+func (b *TextureBucket) filter() gift.Resampling {
+	return resamplingFilters[b.filterName()]
+}
+
+// ScaledSize returns the size of a w x h image in this bucket, keeping the
+// aspect ratio. It may be larger than the image.
+func (b *TextureBucket) ScaledSize(w, h int) (int, int) {
+	var scl float64
+	if b.MaxEdge > 0 {
+		scl = float64(b.MaxEdge) / float64(maxInt(w, h))
+	} else {
+		scl = math.Sqrt(float64(b.Pixels) / float64(w*h))
+	}
+	nw := int(math.Max(1, math.Round(float64(w)*scl)))
+	nh := int(math.Max(1, math.Round(float64(h)*scl)))
+	return nw, nh
+}
+
+func (b *TextureBucket) same(o *TextureBucket) bool {
+	return b.Pixels == o.Pixels && b.MaxEdge == o.MaxEdge && b.filterName() == o.filterName()
+}
+
+// filterName returns the filter name with the default filled in.
+func (b *TextureBucket) filterName() string {
+	if b.Filter == "" {
+		return defaultBucketFilter
+	}
+	return b.Filter
+}
+
+// validateBuckets checks the bucket and precalc configuration. Buckets must
+// not be named like the reserved directories of Imagepath.
+func validateBuckets(buckets []TextureBucket, precalcs []string, reserved map[string]bool) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("no texture sizes defined")
+	}
+	names := make(map[string]bool)
+	for _, b := range buckets {
+		switch {
+		case !bucketNameRe.MatchString(b.Name) || bucketReservedNames[b.Name] || reserved[b.Name]:
+			return fmt.Errorf("invalid texture size name %q", b.Name)
+		case names[b.Name]:
+			return fmt.Errorf("duplicate texture size %q", b.Name)
+		case (b.Pixels > 0) == (b.MaxEdge > 0):
+			return fmt.Errorf("texture size %q needs either pixels or max_edge", b.Name)
+		case b.Pixels < 0 || b.MaxEdge < 0:
+			return fmt.Errorf("texture size %q is negative", b.Name)
+		}
+		if !isFilter(b.filterName()) {
+			return fmt.Errorf("unknown filter %q of texture size %q", b.Filter, b.Name)
+		}
+		names[b.Name] = true
+	}
+	for _, p := range precalcs {
+		if !names[p] {
+			return fmt.Errorf("precalc texture size %q is not defined", p)
+		}
+	}
+	return nil
+}
+
+// texturePaths returns all directories holding textures of a bucket.
+func (x *RequestsHandler) texturePaths(name string) []string {
+	return []string{x.Imagepath + name, x.Imagepath + "P/" + name, x.Imagepath + "ktx2/" + name}
+}
+
+// migrateBuckets compares the configured buckets with the manifest of the
+// stored textures. Textures of removed or redefined buckets are dropped, they
+// are recreated from the full images on demand. Data without a manifest was
+// made with the default buckets. The returned buckets need to be precomputed
+// again.
+func (x *RequestsHandler) migrateBuckets() []string {
+	var stored []TextureBucket
+	data, err := ioutil.ReadFile(x.Imagepath + bucketManifest)
+	switch {
+	case os.IsNotExist(err):
+		stored = defaultTextureBuckets()
+	case check_error(err):
+		return nil
+	default:
+		if check_error(json.Unmarshal(data, &stored)) {
+			return nil
+		}
+	}
+
+	old := make(map[string]*TextureBucket)
+	for i := range stored {
+		old[stored[i].Name] = &stored[i]
+	}
+	var stale []string
+	for name, b := range old {
+		if nb, ok := x.Tsizes[name]; !ok || !nb.same(b) {
+			stale = append(stale, name)
+		}
+	}
+	for _, name := range stale {
+		L().Info("Texture size changed, dropping textures: ", name)
+		for _, p := range x.texturePaths(name) {
+			x.dropDir(p)
+		}
+	}
+
+	var recalc []string
+	for _, name := range x.Tprecalcs {
+		if b, ok := old[name]; !ok || !x.Tsizes[name].same(b) {
+			recalc = append(recalc, name)
+		}
+	}
+
+	manifest := make([]TextureBucket, 0, len(x.Tsizes))
+	for _, b := range x.Tsizes {
+		manifest = append(manifest, *b)
+	}
+	if data, err = json.MarshalIndent(manifest, "", "  "); !check_error(err) {
+		check_error(x.SaveWriteToFile(x.Imagepath+bucketManifest, data))
+	}
+	return recalc
+}
+
+// dropDir moves a directory out of the way and deletes it in the background,
+// so startup is not held up by large texture directories.
+func (x *RequestsHandler) dropDir(p string) {
+	p = strings.TrimSuffix(p, "/")
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return
+	}
+	stale := p + ".stale" + strconv.FormatInt(makeTimestamp(), 10)
+	if check_error(os.Rename(p, stale)) {
+		return
+	}
+	go func() { check_error(os.RemoveAll(stale)) }()
+}
+
+// precalcBuckets creates the textures of newly precomputed buckets for all
+// stored images.
+func (x *RequestsHandler) precalcBuckets(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(x.ImPathF)
+	if check_error(err) {
+		return
+	}
+	L().Info("Precomputing textures: ", names, " for ", len(files), " images")
+	for _, f := range files {
+		ID := f.Name()
+		if f.IsDir() || strings.HasSuffix(ID, ".tmp") {
+			continue
+		}
+		for _, rs := range names {
+			x.presentTexture(&ID, rs)
+		}
+	}
+	L().Info("Precomputing textures done")
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestBucketReservedNames(t *testing.T) {
+	reserved := subdirsOf("images", "images/tracks", "./images/audio/", "images/../fonts", "/var/images")
+	for _, name := range []string{"tracks", "audio"} {
+		if !reserved[name] {
+			t.Errorf("%q not reserved", name)
+		}
+	}
+	if len(reserved) != 2 {
+		t.Errorf("reserved %v", reserved)
+	}
+
+	for _, name := range []string{"F", "tracks", "audio"} {
+		buckets := append(defaultTextureBuckets(), TextureBucket{Name: name, Pixels: 1024})
+		if err := validateBuckets(buckets, defaultTexturePrecalcs(), reserved); err == nil {
+			t.Errorf("texture size %q accepted", name)
+		}
+	}
+	if err := validateBuckets(defaultTextureBuckets(), defaultTexturePrecalcs(), reserved); err != nil {
+		t.Error(err)
+	}
+}
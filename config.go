@@ -49,6 +49,15 @@ type LocalConfig struct {
 	Imagepath string `yaml:"image_path" envconfig:"RENDER_IMAGE_PATH"`
 	Audiopath string `yaml:"audio_path" envconfig:"RENDER_AUDIO_PATH"`
 	LogLevel  int8   `yaml:"loglevel"  envconfig:"RENDER_LOGLEVEL"`
+	// JPEG quality (1-100) of textures derived from photographic images
+	TextureQuality int `yaml:"texture_quality" envconfig:"RENDER_TEXTURE_QUALITY"`
+	// default number of colors returned by the palette endpoint
+	PaletteSize int `yaml:"palette_size" envconfig:"RENDER_PALETTE_SIZE"`
+	// default mip chain mode, "resize" or "pad"
+	MipMode string `yaml:"mip_mode" envconfig:"RENDER_MIP_MODE"`
+	// texture size buckets and the ones computed on upload
+	TextureSizes    []TextureBucket `yaml:"texture_sizes" ignored:"true"`
+	TexturePrecalcs []string        `yaml:"texture_precalcs" envconfig:"RENDER_TEXTURE_PRECALCS"`
 }
 
 func (x *MQTTConfig) Init() {
@@ -100,6 +109,11 @@ func (x *LocalConfig) Init() {
 	x.Imagepath = "./images"
 	x.Audiopath = "./images/tracks"
 	x.LogLevel = 0
+	x.TextureQuality = defaultTextureQuality
+	x.PaletteSize = defaultPaletteSize
+	x.MipMode = mipResize
+	x.TextureSizes = defaultTextureBuckets()
+	x.TexturePrecalcs = defaultTexturePrecalcs()
 }
 
 // Config : structure to hold configuration
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+)
+
+const (
+	maxCubemapFace = 4096
+	// cubemapAspectTolerance is the allowed deviation of a panorama from 2:1
+	cubemapAspectTolerance = 0.05
+)
+
+// CubemapFaces lists the faces in the order they are returned in: +X, -X,
+// +Y, -Y, +Z, -Z, with +Y up and +Z at the center of the panorama.
+var CubemapFaces = [...]string{"px", "nx", "py", "ny", "pz", "nz"}
+
+var errCubemapAspect = errors.New("cubemap: panorama is not equirectangular")
+
+type CubemapResponse struct {
+	Hash  string   `json:"hash"`
+	Size  int      `json:"size"`
+	Faces []string `json:"faces"`
+}
+
+// cubemapDir returns the view direction through the pixel center at s, t in
+// [-1, 1] of a face, following the OpenGL cube map layout.
+func cubemapDir(face int, s, t float64) (float64, float64, float64) {
+	switch face {
+	case 0:
+		return 1, -t, -s
+	case 1:
+		return -1, -t, s
+	case 2:
+		return s, 1, t
+	case 3:
+		return s, -1, -t
+	case 4:
+		return s, -t, 1
+	}
+	return -s, -t, -1
+}
+
+// sampleBilinear samples a premultiplied image at fractional pixel
+// coordinates, wrapping horizontally and clamping vertically.
+func sampleBilinear(src *image.RGBA, fx, fy float64) [4]float64 {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	fx -= 0.5
+	fy = math.Max(0, math.Min(float64(h-1), fy-0.5))
+	x0, y0 := int(math.Floor(fx)), int(math.Floor(fy))
+	ax, ay := fx-float64(x0), fy-float64(y0)
+	x1, y1 := x0+1, minInt(y0+1, h-1)
+	x0, x1 = ((x0%w)+w)%w, ((x1%w)+w)%w
+
+	var out [4]float64
+	for _, p := range [...]struct {
+		x, y int
+		wt   float64
+	}{{x0, y0, (1 - ax) * (1 - ay)}, {x1, y0, ax * (1 - ay)}, {x0, y1, (1 - ax) * ay}, {x1, y1, ax * ay}} {
+		i := src.PixOffset(b.Min.X+p.x, b.Min.Y+p.y)
+		for k := 0; k < 4; k++ {
+			out[k] += float64(src.Pix[i+k]) * p.wt
+		}
+	}
+	return out
+}
+
+// CubemapFace renders one face of an equirectangular panorama.
+func CubemapFace(pano *image.RGBA, face int, size int) *image.RGBA {
+	pw, ph := float64(pano.Bounds().Dx()), float64(pano.Bounds().Dy())
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		t := 2*(float64(y)+0.5)/float64(size) - 1
+		for x := 0; x < size; x++ {
+			s := 2*(float64(x)+0.5)/float64(size) - 1
+			dx, dy, dz := cubemapDir(face, s, t)
+			l := math.Sqrt(dx*dx + dy*dy + dz*dz)
+			u := 0.5 + math.Atan2(dx, dz)/(2*math.Pi)
+			v := math.Acos(dy/l) / math.Pi
+			c := sampleBilinear(pano, u*pw, v*ph)
+			i := dst.PixOffset(x, y)
+			for k := 0; k < 4; k++ {
+				dst.Pix[i+k] = uint8(math.Round(c[k]))
+			}
+		}
+	}
+	return dst
+}
+
+// BuildCubemap converts a stored equirectangular panorama into six stored
+// faces of the given size, or a quarter of the panorama width if size is 0.
+// The face hashes are cached in the asset metadata of the panorama.
+func (x *RequestsHandler) BuildCubemap(ID string, size int) (*CubemapResponse, error) {
+	img, err := x.LoadFull(ID)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if math.Abs(float64(b.Dx())/float64(b.Dy())-2) > 2*cubemapAspectTolerance {
+		return nil, errCubemapAspect
+	}
+	if size == 0 {
+		size = minInt(b.Dx()/4, maxCubemapFace)
+	}
+	res := &CubemapResponse{Hash: ID, Size: size}
+	key := strconv.Itoa(size)
+
+	am, err := x.LoadAssetMeta(ID)
+	if err != nil {
+		return nil, err
+	}
+	if faces, ok := am.Cubemaps[key]; ok {
+		res.Faces = faces
+		return res, nil
+	}
+
+	pano := image.NewRGBA(b.Sub(b.Min))
+	draw.Draw(pano, pano.Bounds(), img, b.Min, draw.Src)
+	photo := isOpaque(pano) && isPhotographic(pano)
+
+	// faces are rendered one at a time, each may take up to 64 MB
+	res.Faces = make([]string, len(CubemapFaces))
+	for i := range CubemapFaces {
+		if res.Faces[i], err = x.writeCubemapFace(ID, CubemapFace(pano, i, size), photo); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = x.UpdateAssetMeta(ID, func(m *AssetMeta) {
+		if m.Cubemaps == nil {
+			m.Cubemaps = make(map[string][]string)
+		}
+		m.Cubemaps[key] = res.Faces
+		for _, f := range res.Faces {
+			m.addDerived(f)
+		}
+	})
+	return res, err
+}
+
+func (x *RequestsHandler) writeCubemapFace(ID string, face *image.RGBA, photo bool) (string, error) {
+	var err error
+	var hash string
+	if photo {
+		err, hash = x.WriteJPEGToF(face, jpegStoreQuality)
+	} else {
+		err, hash = x.WriteToF(face)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err = x.WriteImageMeta(hash, face); err != nil {
+		return "", err
+	}
+	if _, err = x.UpdateAssetMeta(hash, func(m *AssetMeta) { m.Sources = []string{ID} }); err != nil {
+		return "", err
+	}
+	for _, v := range x.Tprecalcs {
+		if err = x.WriteToScaled(hash, face, v); err != nil {
+			return "", err
+		}
+	}
+	return hash, nil
+}
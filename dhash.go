@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	defaultSimilarDist = 10
+	maxSimilarDist     = 32
+)
+
+// DHash computes a 64-bit difference hash (dHash) of an image: the luminance
+// of a 9x8 downsample, one bit per horizontal neighbor pair. Re-encoded,
+// resized or slightly recolored copies of a picture end up a few bits apart.
+func DHash(img image.Image) uint64 {
+	small := resize.Resize(9, 8, img, resize.Lanczos3)
+	b := small.Bounds()
+	var lum [8][9]uint32
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			c := color.NRGBA64Model.Convert(small.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA64)
+			l := (19595*uint32(c.R) + 38470*uint32(c.G) + 7471*uint32(c.B) + 1<<15) >> 16
+			// transparent areas count as white, like in placeholders
+			a := uint32(c.A)
+			lum[y][x] = (l*a + 0xffff*(0xffff-a)) / 0xffff
+		}
+	}
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if lum[y][x] < lum[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func formatDHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func parseDHash(s string) (uint64, bool) {
+	h, err := strconv.ParseUint(s, 16, 64)
+	return h, err == nil && len(s) == 16
+}
+
+// dHashIndex keeps the difference hashes of all stored images in memory.
+type dHashIndex struct {
+	sync.RWMutex
+	hashes map[string]uint64
+}
+
+func newDHashIndex() *dHashIndex {
+	return &dHashIndex{hashes: make(map[string]uint64)}
+}
+
+func (p *dHashIndex) Set(ID string, h uint64) {
+	p.Lock()
+	p.hashes[ID] = h
+	p.Unlock()
+}
+
+func (p *dHashIndex) Get(ID string) (uint64, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	h, ok := p.hashes[ID]
+	return h, ok
+}
+
+type SimilarImage struct {
+	Hash     string `json:"hash"`
+	Distance int    `json:"distance"`
+}
+
+// Similar returns all images other than ID whose hash differs from h in at
+// most maxdist bits, closest first.
+func (p *dHashIndex) Similar(ID string, h uint64, maxdist int) []SimilarImage {
+	p.RLock()
+	res := []SimilarImage{}
+	for k, v := range p.hashes {
+		if k == ID {
+			continue
+		}
+		if d := bits.OnesCount64(h ^ v); d <= maxdist {
+			res = append(res, SimilarImage{Hash: k, Distance: d})
+		}
+	}
+	p.RUnlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Distance != res[j].Distance {
+			return res[i].Distance < res[j].Distance
+		}
+		return res[i].Hash < res[j].Hash
+	})
+	return res
+}
+
+// loadDHashIndex fills the index from the hashes stored in the asset
+// metadata. Images stored before hashes were introduced are not decoded here,
+// they are hashed once their similar images are requested.
+func (x *RequestsHandler) loadDHashIndex() {
+	files, err := ioutil.ReadDir(x.ImPathF)
+	if check_error(err) {
+		return
+	}
+	loaded := 0
+	for _, f := range files {
+		ID := f.Name()
+		if f.IsDir() || strings.HasSuffix(ID, ".tmp") {
+			continue
+		}
+		am, err := x.LoadAssetMeta(ID)
+		if check_error(err) {
+			continue
+		}
+		if h, ok := parseDHash(am.DHash); ok {
+			x.DHashes.Set(ID, h)
+			loaded++
+		}
+	}
+	L().Info("Difference hashes loaded: ", loaded)
+}
+
+// imageDHash returns the difference hash of a stored image, computing and
+// storing it if the image has none yet.
+func (x *RequestsHandler) imageDHash(ID string) (uint64, error) {
+	if h, ok := x.DHashes.Get(ID); ok {
+		return h, nil
+	}
+	img, err := x.LoadFull(ID)
+	if err != nil {
+		return 0, err
+	}
+	h := DHash(img)
+	if _, err = x.UpdateAssetMeta(ID, func(m *AssetMeta) { m.DHash = formatDHash(h) }); err != nil {
+		return 0, err
+	}
+	x.DHashes.Set(ID, h)
+	return h, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func TestDHashIndex(t *testing.T) {
+	x := newTestHandler(t)
+	var IDs []string
+	for _, w := range []int{120, 121} {
+		var enc bytes.Buffer
+		if err := png.Encode(&enc, photoTestImage(w, 80)); err != nil {
+			t.Fatal(err)
+		}
+		err, ID := x.ProcessImage(enc.Bytes(), 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		IDs = append(IDs, ID)
+	}
+	// the second one is stored as before hashes were introduced
+	if _, err := x.UpdateAssetMeta(IDs[1], func(m *AssetMeta) { m.DHash = "" }); err != nil {
+		t.Fatal(err)
+	}
+
+	x.DHashes = newDHashIndex()
+	x.loadDHashIndex()
+	if _, ok := x.DHashes.Get(IDs[0]); !ok {
+		t.Error("stored hash not loaded")
+	}
+	if _, ok := x.DHashes.Get(IDs[1]); ok {
+		t.Error("missing hash computed on load")
+	}
+
+	h, err := x.imageDHash(IDs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if am, _ := x.LoadAssetMeta(IDs[1]); am.DHash != formatDHash(h) {
+		t.Errorf("hash not stored: %q", am.DHash)
+	}
+	if sim := x.DHashes.Similar(IDs[1], h, defaultSimilarDist); len(sim) != 1 || sim[0].Hash != IDs[0] {
+		t.Errorf("similar images %v", sim)
+	}
+}
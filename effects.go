@@ -0,0 +1,126 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/gift"
+	"github.com/oakmound/oak/v3/alg/floatgeom"
+	"github.com/oakmound/oak/v3/render"
+)
+
+// maxBlur limits blur radii, the cost of a blur grows with its radius.
+const maxBlur = 100
+
+// defaultShadowColor is a half transparent black.
+var defaultShadowColor = []uint32{0, 0, 0, 128}
+
+// ShadowDesc is a drop shadow offset by X, Y. Blur is the blur radius as in
+// CSS box-shadow and text-shadow, twice the standard deviation of the
+// gaussian, see shadowSigma. Color is straight alpha and defaults to
+// defaultShadowColor.
+type ShadowDesc struct {
+	X     int      `json:"x"`
+	Y     int      `json:"y"`
+	Blur  float64  `json:"blur"`
+	Color []uint32 `json:"color"`
+}
+
+// shadowSigma returns the standard deviation of the gaussian blurring a
+// shadow, half its blur radius like in browsers.
+func shadowSigma(s *ShadowDesc) float64 {
+	return s.Blur / 2
+}
+
+func validShadow(s *ShadowDesc) bool {
+	return s == nil || validBlur(s.Blur) && (s.Color == nil || len(s.Color) == 3 || len(s.Color) == 4)
+}
+
+func validBlur(r float64) bool {
+	return r >= 0 && r <= maxBlur
+}
+
+// blurPad is how far a gaussian blur spreads beyond the blurred pixels.
+func blurPad(sigma float64) int {
+	return int(math.Ceil(3 * sigma))
+}
+
+// blurImage blurs an image on a canvas enlarged by the spread of the blur.
+// It returns the blurred image and the padding added on each side.
+func blurImage(img *image.RGBA, sigma float64) (*image.RGBA, int) {
+	pad := blurPad(sigma)
+	b := img.Bounds()
+	padded := image.NewRGBA(image.Rect(0, 0, b.Dx()+2*pad, b.Dy()+2*pad))
+	draw.Draw(padded, b.Sub(b.Min).Add(image.Pt(pad, pad)), img, b.Min, draw.Src)
+	if sigma <= 0 {
+		return padded, pad
+	}
+	dst := image.NewRGBA(padded.Bounds())
+	gift.New(gift.GaussianBlur(float32(sigma))).Draw(dst, padded)
+	return dst, pad
+}
+
+// shadowImage returns the shadow cast by a coverage mask, blurred and padded
+// by the spread of the blur, and the padding.
+func shadowImage(mask *image.Alpha, s *ShadowDesc) (*image.RGBA, int) {
+	clr := s.Color
+	if clr == nil {
+		clr = defaultShadowColor
+	}
+	// the frame colors are straight alpha, premultiply them here
+	a := uint32(255)
+	if len(clr) == 4 {
+		a = uint32(minInt(int(clr[3]), 255))
+	}
+	var col [4]uint32
+	for k := 0; k < 3; k++ {
+		col[k] = uint32(minInt(int(clr[k]), 255)) * a / 255
+	}
+	col[3] = a
+
+	b := mask.Bounds()
+	shadow := image.NewRGBA(b.Sub(b.Min))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			m := uint32(mask.Pix[mask.PixOffset(b.Min.X+x, b.Min.Y+y)])
+			if m == 0 {
+				continue
+			}
+			o := shadow.PixOffset(x, y)
+			for k := 0; k < 4; k++ {
+				shadow.Pix[o+k] = uint8((col[k]*m + 127) / 255)
+			}
+		}
+	}
+	return blurImage(shadow, shadowSigma(s))
+}
+
+// alphaMask returns the alpha channel of an image.
+func alphaMask(img *image.RGBA) *image.Alpha {
+	mask := image.NewAlpha(img.Bounds())
+	for i := range mask.Pix {
+		mask.Pix[i] = img.Pix[i*4+3]
+	}
+	return mask
+}
+
+// appendShadow adds the shadow of a mask placed at x, y to a composite.
+func appendShadow(img *render.CompositeM, mask *image.Alpha, s *ShadowDesc, x, y float64) {
+	shadow, pad := shadowImage(mask, s)
+	img.AppendOffset(render.NewSprite(0, 0, shadow),
+		floatgeom.Point2{x + float64(s.X-pad), y + float64(s.Y-pad)})
+}
+
+// backdrop returns what has been drawn to a composite so far inside r,
+// blurred and clipped by a mask of the size of r.
+func backdrop(img *render.CompositeM, r image.Rectangle, sigma float64, mask *image.Alpha) *image.RGBA {
+	below := img.ToSprite().GetRGBA()
+	region := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(region, region.Bounds(), below, r.Min, draw.Src)
+	// the edges are clamped rather than faded, as behind a pane of glass
+	dst := image.NewRGBA(region.Bounds())
+	gift.New(gift.GaussianBlur(float32(sigma))).Draw(dst, region)
+	applyMask(dst, mask)
+	return dst
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+// TestShadowBlurRadius checks that the shadow blur is a CSS radius, blurring
+// with half of it as the standard deviation.
+func TestShadowBlurRadius(t *testing.T) {
+	mask := image.NewAlpha(image.Rect(0, 0, 4, 4))
+	for i := range mask.Pix {
+		mask.Pix[i] = 255
+	}
+	s := &ShadowDesc{Blur: 8, Color: []uint32{0, 0, 0, 255}}
+	if sigma := shadowSigma(s); sigma != 4 {
+		t.Fatalf("sigma %v for radius 8", sigma)
+	}
+
+	shadow, pad := shadowImage(mask, s)
+	black := image.NewRGBA(mask.Bounds())
+	for i := 0; i < len(black.Pix); i += 4 {
+		black.Pix[i+3] = 255
+	}
+	want, wpad := blurImage(black, 4)
+	if pad != wpad || shadow.Bounds() != want.Bounds() {
+		t.Fatalf("shadow padded by %d to %v, want %d to %v", pad, shadow.Bounds(), wpad, want.Bounds())
+	}
+	for y := 0; y < want.Bounds().Dy(); y++ {
+		for x := 0; x < want.Bounds().Dx(); x++ {
+			if got, w := shadow.RGBAAt(x, y), want.RGBAAt(x, y); got != w {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, w)
+			}
+		}
+	}
+}
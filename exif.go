@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+
+	"github.com/disintegration/gift"
+)
+
+const (
+	exifOrientationTag = 0x0112
+	jpegStoreQuality   = 95
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegSegment is a marker segment preceding the scan data of a JPEG stream.
+// Data holds the segment payload without the marker and length bytes.
+type jpegSegment struct {
+	Marker byte
+	Data   []byte
+}
+
+// splitJPEG returns the marker segments of a JPEG stream and the remaining
+// bytes starting with the SOS marker.
+func splitJPEG(src []byte) ([]jpegSegment, []byte, bool) {
+	if len(src) < 4 || src[0] != 0xff || src[1] != 0xd8 {
+		return nil, nil, false
+	}
+	var segs []jpegSegment
+	pos := 2
+	for pos+4 <= len(src) {
+		if src[pos] != 0xff {
+			return nil, nil, false
+		}
+		marker := src[pos+1]
+		if marker == 0xff {
+			pos++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			return segs, src[pos:], true
+		}
+		n := int(binary.BigEndian.Uint16(src[pos+2:]))
+		if n < 2 || pos+2+n > len(src) {
+			return nil, nil, false
+		}
+		segs = append(segs, jpegSegment{Marker: marker, Data: src[pos+4 : pos+2+n]})
+		pos += 2 + n
+	}
+	return nil, nil, false
+}
+
+// jpegExif returns the TIFF structure of the EXIF block of a JPEG stream.
+func jpegExif(src []byte) []byte {
+	segs, _, ok := splitJPEG(src)
+	if !ok {
+		return nil
+	}
+	for _, s := range segs {
+		if s.Marker == 0xe1 && bytes.HasPrefix(s.Data, exifHeader) {
+			return s.Data[len(exifHeader):]
+		}
+	}
+	return nil
+}
+
+// pngExif returns the content of the eXIf chunk of a PNG stream.
+func pngExif(src []byte) []byte {
+	if len(src) < 8 || string(src[1:4]) != "PNG" {
+		return nil
+	}
+	for pos := 8; pos+8 <= len(src); {
+		n := int(binary.BigEndian.Uint32(src[pos:]))
+		if n < 0 || pos+12+n > len(src) {
+			return nil
+		}
+		typ := string(src[pos+4 : pos+8])
+		if typ == "eXIf" {
+			return src[pos+8 : pos+8+n]
+		}
+		if typ == "IDAT" || typ == "IEND" {
+			return nil
+		}
+		pos += 12 + n
+	}
+	return nil
+}
+
+// webpExif returns the content of the EXIF chunk of an extended WebP stream.
+func webpExif(src []byte) []byte {
+	for _, c := range riffChunks(src) {
+		if c.ID == "EXIF" {
+			return bytes.TrimPrefix(c.Data, exifHeader)
+		}
+	}
+	return nil
+}
+
+type riffChunk struct {
+	ID   string
+	Data []byte
+}
+
+func riffChunks(src []byte) []riffChunk {
+	if len(src) < 12 || string(src[:4]) != "RIFF" || string(src[8:12]) != "WEBP" {
+		return nil
+	}
+	var chunks []riffChunk
+	for pos := 12; pos+8 <= len(src); {
+		n := int(binary.LittleEndian.Uint32(src[pos+4:]))
+		if n < 0 || pos+8+n > len(src) {
+			break
+		}
+		chunks = append(chunks, riffChunk{ID: string(src[pos : pos+4]), Data: src[pos+8 : pos+8+n]})
+		pos += 8 + n + n&1
+	}
+	return chunks
+}
+
+// tiffOrientation reads the orientation tag from IFD0 of an EXIF TIFF block.
+// It returns 1 (no transformation) when the tag is missing or malformed.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(bo.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			break
+		}
+		if bo.Uint16(tiff[e:]) != exifOrientationTag {
+			continue
+		}
+		// type SHORT, value stored inline in the first two bytes
+		if bo.Uint16(tiff[e+2:]) != 3 {
+			return 1
+		}
+		if o := int(bo.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+			return o
+		}
+		return 1
+	}
+	return 1
+}
+
+// exifOrientation returns the EXIF orientation (1-8) of an encoded image.
+func exifOrientation(src []byte, format string) int {
+	switch format {
+	case "jpeg":
+		return tiffOrientation(jpegExif(src))
+	case "png":
+		return tiffOrientation(pngExif(src))
+	case "webp":
+		return tiffOrientation(webpExif(src))
+	}
+	return 1
+}
+
+// applyOrientation transforms the decoded pixels so that the image is
+// displayed upright without an orientation tag.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	var f gift.Filter
+	switch orientation {
+	case 2:
+		f = gift.FlipHorizontal()
+	case 3:
+		f = gift.Rotate180()
+	case 4:
+		f = gift.FlipVertical()
+	case 5:
+		f = gift.Transpose()
+	case 6:
+		f = gift.Rotate270()
+	case 7:
+		f = gift.Transverse()
+	case 8:
+		f = gift.Rotate90()
+	default:
+		return img
+	}
+	g := gift.New(f)
+	dst := image.NewNRGBA(g.Bounds(img.Bounds()))
+	g.Draw(dst, img)
+	return dst
+}
+
+// stripJPEGMetadata removes EXIF (including GPS), XMP, IPTC and comment
+// segments. JFIF, ICC profile and Adobe segments are kept since they affect
+// how the pixels are decoded.
+func stripJPEGMetadata(src []byte) []byte {
+	segs, scan, ok := splitJPEG(src)
+	if !ok {
+		return src
+	}
+	var w bytes.Buffer
+	w.Write([]byte{0xff, 0xd8})
+	for _, s := range segs {
+		switch s.Marker {
+		case 0xe1, 0xed, 0xfe:
+			continue
+		}
+		w.Write([]byte{0xff, s.Marker})
+		binary.Write(&w, binary.BigEndian, uint16(len(s.Data)+2))
+		w.Write(s.Data)
+	}
+	w.Write(scan)
+	return w.Bytes()
+}
+
+// pngMetadataChunks are the ancillary PNG chunks holding text, EXIF and
+// timestamps.
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+func stripPNGMetadata(src []byte) []byte {
+	chunks, err := pngChunks(src)
+	if err != nil {
+		return src
+	}
+	var w bytes.Buffer
+	w.Write(pngSignature)
+	for _, c := range chunks {
+		if !pngMetadataChunks[c.Type] {
+			writePNGChunk(&w, c.Type, c.Data)
+		}
+	}
+	return w.Bytes()
+}
+
+// stripWebPMetadata removes the EXIF and XMP chunks and their VP8X flags.
+func stripWebPMetadata(src []byte) []byte {
+	chunks := riffChunks(src)
+	if chunks == nil {
+		return src
+	}
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		switch c.ID {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			if len(c.Data) > 0 {
+				c.Data = append([]byte(nil), c.Data...)
+				c.Data[0] &^= webpEXIFFlag | webpXMPFlag
+			}
+		}
+		body = appendRIFFChunk(body, c.ID, c.Data)
+	}
+	return appendRIFFChunk(nil, "RIFF", body)
+}
+
+// gifSubBlocksEnd returns the position after the sub-blocks starting at pos.
+func gifSubBlocksEnd(src []byte, pos int) (int, bool) {
+	for pos < len(src) {
+		n := int(src[pos])
+		pos++
+		if n == 0 {
+			return pos, true
+		}
+		pos += n
+	}
+	return 0, false
+}
+
+// stripGIFMetadata removes comments and application extensions other than
+// the loop count, which is where XMP is stored.
+func stripGIFMetadata(src []byte) []byte {
+	if len(src) < 13 || string(src[:3]) != "GIF" {
+		return src
+	}
+	pos := 13
+	if src[10]&0x80 != 0 {
+		pos += 3 << (src[10]&7 + 1)
+	}
+	if pos > len(src) {
+		return src
+	}
+	out := append([]byte(nil), src[:pos]...)
+	for pos < len(src) {
+		start := pos
+		keep := true
+		var ok bool
+		switch src[pos] {
+		case 0x21: // extension
+			if pos+2 > len(src) {
+				return src
+			}
+			label := src[pos+1]
+			if pos, ok = gifSubBlocksEnd(src, pos+2); !ok {
+				return src
+			}
+			switch label {
+			case 0xfe:
+				keep = false
+			case 0xff:
+				id := ""
+				if start+14 <= pos && src[start+2] == 11 {
+					id = string(src[start+3 : start+14])
+				}
+				keep = id == "NETSCAPE2.0" || id == "ANIMEXTS1.0"
+			}
+		case 0x2c: // image descriptor
+			if pos+11 > len(src) {
+				return src
+			}
+			flags := src[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+			// LZW minimum code size
+			if pos, ok = gifSubBlocksEnd(src, pos+1); !ok {
+				return src
+			}
+		case 0x3b: // trailer
+			return append(out, 0x3b)
+		default:
+			return src
+		}
+		if keep {
+			out = append(out, src[start:pos]...)
+		}
+	}
+	return src
+}
+
+// stripMetadata removes EXIF, XMP, text and comments from an image stored as
+// uploaded.
+func stripMetadata(src []byte, format string) []byte {
+	switch format {
+	case "jpeg":
+		return stripJPEGMetadata(src)
+	case "png":
+		return stripPNGMetadata(src)
+	case "webp":
+		return stripWebPMetadata(src)
+	case "gif":
+		return stripGIFMetadata(src)
+	}
+	return src
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"testing"
+)
+
+// orientationQuadrants are the colors of the quadrants of the upright test
+// image, top left, top right, bottom left and bottom right.
+var orientationQuadrants = [4]color.RGBA{
+	{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255},
+}
+
+// uprightTestImage is 64x32 with a differently colored quadrant in each
+// corner, so every orientation yields a different image.
+func uprightTestImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, orientationQuadrants[y/16*2+x/32])
+		}
+	}
+	return img
+}
+
+// exifSegment returns an APP1 payload with an EXIF block holding only the
+// orientation tag.
+func exifSegment(orientation int) []byte {
+	var w bytes.Buffer
+	w.Write(exifHeader)
+	w.WriteString("MM\x00\x2a")
+	binary.Write(&w, binary.BigEndian, uint32(8))
+	binary.Write(&w, binary.BigEndian, uint16(1))
+	binary.Write(&w, binary.BigEndian, []uint16{exifOrientationTag, 3})
+	binary.Write(&w, binary.BigEndian, uint32(1))
+	binary.Write(&w, binary.BigEndian, []uint16{uint16(orientation), 0})
+	binary.Write(&w, binary.BigEndian, uint32(0))
+	return w.Bytes()
+}
+
+// withSegments inserts marker segments right after the SOI marker.
+func withSegments(src []byte, segs ...jpegSegment) []byte {
+	var w bytes.Buffer
+	w.Write(src[:2])
+	for _, s := range segs {
+		w.Write([]byte{0xff, s.Marker})
+		binary.Write(&w, binary.BigEndian, uint16(len(s.Data)+2))
+		w.Write(s.Data)
+	}
+	w.Write(src[2:])
+	return w.Bytes()
+}
+
+func TestEXIFOrientation(t *testing.T) {
+	// the camera stores the pixels transformed by the inverse of the tag
+	inverse := map[int]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 8, 7: 7, 8: 6}
+	x := newTestHandler(t)
+	for orientation := 1; orientation <= 8; orientation++ {
+		stored := applyOrientation(uprightTestImage(), inverse[orientation])
+		var enc bytes.Buffer
+		if err := jpeg.Encode(&enc, stored, &jpeg.Options{Quality: 95}); err != nil {
+			t.Fatal(err)
+		}
+		src := withSegments(enc.Bytes(),
+			jpegSegment{Marker: 0xe1, Data: exifSegment(orientation)},
+			jpegSegment{Marker: 0xed, Data: []byte("Photoshop 3.0\x00")},
+			jpegSegment{Marker: 0xfe, Data: []byte("comment")},
+		)
+		if got := exifOrientation(src, "jpeg"); got != orientation {
+			t.Fatalf("orientation %d: read %d", orientation, got)
+		}
+
+		err, ID := x.ProcessImage(src, 0, "")
+		if err != nil {
+			t.Fatalf("orientation %d: %v", orientation, err)
+		}
+		data, err := ioutil.ReadFile(x.ImPathF + ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segs, _, ok := splitJPEG(data)
+		if !ok {
+			t.Fatalf("orientation %d: stored image is not a JPEG", orientation)
+		}
+		for _, s := range segs {
+			if s.Marker == 0xe1 || s.Marker == 0xed || s.Marker == 0xfe {
+				t.Errorf("orientation %d: segment %#x kept", orientation, s.Marker)
+			}
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 32 {
+			t.Fatalf("orientation %d: stored size %v", orientation, b.Size())
+		}
+		for q, want := range orientationQuadrants {
+			px, py := q%2*32+16, q/2*16+8
+			r, g, b, _ := img.At(px, py).RGBA()
+			if channelDiff(r>>8, want.R) > 24 || channelDiff(g>>8, want.G) > 24 || channelDiff(b>>8, want.B) > 24 {
+				t.Errorf("orientation %d: pixel %d,%d is %d,%d,%d, want %v", orientation, px, py, r>>8, g>>8, b>>8, want)
+			}
+		}
+	}
+}
+
+func channelDiff(a uint32, b uint8) uint32 {
+	if a > uint32(b) {
+		return a - uint32(b)
+	}
+	return uint32(b) - a
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/oakmound/oak/v3/render"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+const (
+	borderSolid  = "solid"
+	borderDashed = "dashed"
+	borderDotted = "dotted"
+
+	// bezierArc is the control point distance of a cubic quarter circle
+	bezierArc = 0.5522847498
+)
+
+var borderStyles = []string{borderSolid, borderDashed, borderDotted}
+
+func isBorderStyle(style string) bool {
+	for _, s := range borderStyles {
+		if s == style {
+			return true
+		}
+	}
+	return false
+}
+
+// sideIndex returns the index of the value for a side (top, right, bottom,
+// left) in a list of one, two or four values as in CSS, or -1 for other
+// lengths.
+func sideIndex(n, side int) int {
+	switch n {
+	case 1:
+		return 0
+	case 2:
+		return side % 2
+	case 4:
+		return side
+	}
+	return -1
+}
+
+// cssSides expands the one, two or four values of a list to top, right,
+// bottom and left. Negative values are invalid.
+func cssSides(v []int) ([4]int, bool) {
+	var in [4]int
+	if sideIndex(len(v), 0) < 0 {
+		return in, false
+	}
+	for side := range in {
+		in[side] = v[sideIndex(len(v), side)]
+		if in[side] < 0 {
+			return in, false
+		}
+	}
+	return in, true
+}
+
+func validRadius(r []float64) bool {
+	if len(r) != 0 && len(r) != 1 && len(r) != 4 {
+		return false
+	}
+	for _, v := range r {
+		if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func validBorderColors(c [][]uint32) bool {
+	return len(c) == 0 || sideIndex(len(c), 0) >= 0
+}
+
+// hasRadius reports whether a frame has any rounded corner.
+func hasRadius(frame *FrameDesc) bool {
+	for _, r := range frame.Radius {
+		if r > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyBorder reports whether a frame only uses Thickness and Color, drawn
+// as four lines as before the other border fields existed.
+func legacyBorder(frame *FrameDesc) bool {
+	return len(frame.Radius) == 0 && len(frame.BorderWidth) == 0 &&
+		len(frame.BorderColor) == 0 && frame.BorderStyle == ""
+}
+
+// frameShape is the outline of a frame: corner radii as top-left, top-right,
+// bottom-right, bottom-left, border widths and colors as top, right, bottom,
+// left.
+type frameShape struct {
+	w, h   int
+	radii  [4]float64
+	widths [4]int
+	colors [4]color.Color
+	style  string
+}
+
+func newFrameShape(frame *FrameDesc) *frameShape {
+	s := &frameShape{w: frame.Width, h: frame.Height, style: frame.BorderStyle}
+	if s.style == "" {
+		s.style = borderSolid
+	}
+	if n := len(frame.Radius); n == 1 || n == 4 {
+		for i := range s.radii {
+			s.radii[i] = frame.Radius[i%n]
+		}
+	}
+	// like CSS, scale all radii down evenly if adjacent ones overlap
+	f := 1.0
+	for i, side := range []float64{float64(s.w), float64(s.h), float64(s.w), float64(s.h)} {
+		if sum := s.radii[i] + s.radii[(i+1)%4]; sum > side {
+			f = math.Min(f, side/sum)
+		}
+	}
+	for i := range s.radii {
+		s.radii[i] *= f
+	}
+
+	if widths, ok := cssSides(frame.BorderWidth); ok {
+		s.widths = widths
+	} else {
+		s.widths = [4]int{frame.Thickness, frame.Thickness, frame.Thickness, frame.Thickness}
+	}
+	for side := range s.colors {
+		if i := sideIndex(len(frame.BorderColor), side); i >= 0 {
+			s.colors[side] = getStraightColor(frame.BorderColor[i])
+		} else {
+			s.colors[side] = getColor(frame.Color)
+		}
+	}
+	return s
+}
+
+// pathBuilder is implemented by vector.Rasterizer and rasterxPath.
+type pathBuilder interface {
+	MoveTo(ax, ay float32)
+	LineTo(bx, by float32)
+	CubeTo(bx, by, cx, cy, dx, dy float32)
+	ClosePath()
+}
+
+// rasterxPath adapts a rasterx path to pathBuilder.
+type rasterxPath struct {
+	rasterx.Adder
+}
+
+func (p rasterxPath) MoveTo(ax, ay float32) {
+	p.Start(rasterx.ToFixedP(float64(ax), float64(ay)))
+}
+
+func (p rasterxPath) LineTo(bx, by float32) {
+	p.Line(rasterx.ToFixedP(float64(bx), float64(by)))
+}
+
+func (p rasterxPath) CubeTo(bx, by, cx, cy, dx, dy float32) {
+	p.CubeBezier(rasterx.ToFixedP(float64(bx), float64(by)),
+		rasterx.ToFixedP(float64(cx), float64(cy)), rasterx.ToFixedP(float64(dx), float64(dy)))
+}
+
+func (p rasterxPath) ClosePath() {
+	p.Stop(true)
+}
+
+// roundedRect adds a clockwise rectangle with elliptical corners of radii rx,
+// ry, in the corner order of frameShape.
+func roundedRect(p pathBuilder, x0, y0, x1, y1 float64, rx, ry [4]float64) {
+	k := bezierArc
+	f := func(v float64) float32 { return float32(v) }
+	p.MoveTo(f(x0+rx[0]), f(y0))
+	p.LineTo(f(x1-rx[1]), f(y0))
+	p.CubeTo(f(x1-rx[1]+k*rx[1]), f(y0), f(x1), f(y0+ry[1]-k*ry[1]), f(x1), f(y0+ry[1]))
+	p.LineTo(f(x1), f(y1-ry[2]))
+	p.CubeTo(f(x1), f(y1-ry[2]+k*ry[2]), f(x1-rx[2]+k*rx[2]), f(y1), f(x1-rx[2]), f(y1))
+	p.LineTo(f(x0+rx[3]), f(y1))
+	p.CubeTo(f(x0+rx[3]-k*rx[3]), f(y1), f(x0), f(y1-ry[3]+k*ry[3]), f(x0), f(y1-ry[3]))
+	p.LineTo(f(x0), f(y0+ry[0]))
+	p.CubeTo(f(x0), f(y0+ry[0]-k*ry[0]), f(x0+rx[0]-k*rx[0]), f(y0), f(x0+rx[0]), f(y0))
+	p.ClosePath()
+}
+
+// insetRadii returns the corner radii of the shape inset by the given
+// amounts per side. Corners become elliptical where the sides differ.
+func (s *frameShape) insetRadii(t, r, b, l float64) ([4]float64, [4]float64) {
+	var rx, ry [4]float64
+	xs := [4]float64{l, r, r, l}
+	ys := [4]float64{t, t, b, b}
+	for i, rad := range s.radii {
+		rx[i] = math.Max(0, rad-xs[i])
+		ry[i] = math.Max(0, rad-ys[i])
+	}
+	return rx, ry
+}
+
+// fillMask rasterizes an anti-aliased rounded rectangle inset from the frame
+// bounds by the given amounts per side.
+func (s *frameShape) fillMask(t, r, b, l float64) *image.Alpha {
+	mask := image.NewAlpha(image.Rect(0, 0, s.w, s.h))
+	x0, y0, x1, y1 := l, t, float64(s.w)-r, float64(s.h)-b
+	if x1 <= x0 || y1 <= y0 {
+		return mask
+	}
+	rx, ry := s.insetRadii(t, r, b, l)
+	z := vector.NewRasterizer(s.w, s.h)
+	roundedRect(z, x0, y0, x1, y1, rx, ry)
+	z.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+	return mask
+}
+
+// outerMask is the coverage of the frame shape.
+func (s *frameShape) outerMask() *image.Alpha {
+	return s.fillMask(0, 0, 0, 0)
+}
+
+// innerMask is the coverage of the area inside the border.
+func (s *frameShape) innerMask() *image.Alpha {
+	w := s.widths
+	return s.fillMask(float64(w[0]), float64(w[1]), float64(w[2]), float64(w[3]))
+}
+
+// dashMask strokes the center line of the border with the dash pattern of the
+// style, using the widest side as stroke width.
+func (s *frameShape) dashMask() *image.Alpha {
+	mask := image.NewAlpha(image.Rect(0, 0, s.w, s.h))
+	w := s.widths
+	width := float64(maxInt(maxInt(w[0], w[1]), maxInt(w[2], w[3])))
+	t, r, b, l := float64(w[0])/2, float64(w[1])/2, float64(w[2])/2, float64(w[3])/2
+	scanner := rasterx.NewScannerGV(s.w, s.h, mask, mask.Bounds())
+	scanner.SetColor(color.Opaque)
+	d := rasterx.NewDasher(s.w, s.h, scanner)
+	dashes, capf := []float64{2 * width, width}, rasterx.ButtCap
+	if s.style == borderDotted {
+		// a dash of almost no length gets round caps on both ends, a dot
+		dashes, capf = []float64{0.01, 2*width - 0.01}, rasterx.RoundCap
+	}
+	d.SetStroke(fixed.Int26_6(width*64), 4<<6, capf, nil, rasterx.RoundGap, rasterx.Round, dashes, 0)
+	rx, ry := s.insetRadii(t, r, b, l)
+	roundedRect(rasterxPath{d}, l, t, float64(s.w)-r, float64(s.h)-b, rx, ry)
+	d.Draw()
+	return mask
+}
+
+// sideWeight splits a corner between its horizontal and vertical side along
+// the line from the outer to the inner corner, as CSS does. dx, dy is the
+// distance of a pixel from the corner, th and tv the widths of the
+// horizontal and vertical side. It returns the share of the horizontal side,
+// anti-aliased across the line.
+func sideWeight(dx, dy float64, th, tv int) float64 {
+	if th == 0 && tv == 0 {
+		return 0.5
+	}
+	n := math.Hypot(float64(th), float64(tv))
+	return math.Max(0, math.Min(1, 0.5+(dx*float64(th)-dy*float64(tv))/n))
+}
+
+// borderImage draws the border of the frame, or returns nil if it has none.
+func (s *frameShape) borderImage() *image.RGBA {
+	w := s.widths
+	if w[0]+w[1]+w[2]+w[3] == 0 || s.w <= 0 || s.h <= 0 {
+		return nil
+	}
+	outer, inner := s.outerMask(), s.innerMask()
+	var dash *image.Alpha
+	if s.style != borderSolid {
+		dash = s.dashMask()
+	}
+	var cols [4][4]float64
+	for side, c := range s.colors {
+		r, g, b, a := c.RGBA()
+		cols[side] = [4]float64{float64(r) / 0xffff, float64(g) / 0xffff, float64(b) / 0xffff, float64(a) / 0xffff}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, s.w, s.h))
+	for y := 0; y < s.h; y++ {
+		py := float64(y) + 0.5
+		for x := 0; x < s.w; x++ {
+			i := y*outer.Stride + x
+			cov := float64(outer.Pix[i]) - float64(inner.Pix[i])
+			if dash != nil {
+				cov *= float64(dash.Pix[i]) / 255
+			}
+			if cov <= 0 {
+				continue
+			}
+			cov /= 255
+			px := float64(x) + 0.5
+			hs, vs := 0, 3
+			dx, dy := px, py
+			if py > float64(s.h)/2 {
+				hs, dy = 2, float64(s.h)-py
+			}
+			if px > float64(s.w)/2 {
+				vs, dx = 1, float64(s.w)-px
+			}
+			hw := sideWeight(dx, dy, w[hs], w[vs])
+			o := dst.PixOffset(x, y)
+			for k := 0; k < 4; k++ {
+				v := cov * (hw*cols[hs][k] + (1-hw)*cols[vs][k])
+				dst.Pix[o+k] = uint8(v*255 + 0.5)
+			}
+		}
+	}
+	return dst
+}
+
+// applyMask multiplies an image with a coverage mask of the same size.
+func applyMask(img *image.RGBA, mask *image.Alpha) {
+	for y := 0; y < img.Rect.Dy(); y++ {
+		row := img.Pix[y*img.Stride:]
+		mrow := mask.Pix[y*mask.Stride:]
+		for x := 0; x < img.Rect.Dx(); x++ {
+			m := uint32(mrow[x])
+			if m == 255 {
+				continue
+			}
+			for k := 0; k < 4; k++ {
+				row[x*4+k] = uint8((uint32(row[x*4+k])*m + 127) / 255)
+			}
+		}
+	}
+}
+
+// blendMask replaces dst by src where the mask is set, blending in between.
+func blendMask(dst, src *image.RGBA, mask *image.Alpha) {
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		drow := dst.Pix[y*dst.Stride:]
+		srow := src.Pix[y*src.Stride:]
+		mrow := mask.Pix[y*mask.Stride:]
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			m := uint32(mrow[x])
+			for k := x * 4; k < x*4+4; k++ {
+				drow[k] = uint8((uint32(srow[k])*m + uint32(drow[k])*(255-m) + 127) / 255)
+			}
+		}
+	}
+}
+
+// flattenComposite draws a composite into a w x h canvas, cutting off what
+// lies outside.
+func flattenComposite(c *render.CompositeM, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	src := c.ToSprite().GetRGBA()
+	draw.Draw(dst, dst.Bounds(), src, image.Point{}, draw.Src)
+	return dst
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	gradientLinear = "linear"
+	gradientRadial = "radial"
+)
+
+// GradientDesc is a gradient fill. Linear gradients run in the direction of
+// Angle in degrees, clockwise from the top as in CSS, so 90 goes from left to
+// right, across the whole frame. Radial gradients spread from the center,
+// given as a fraction of the frame size and defaulting to the middle, to
+// Radius in pixels, defaulting to the farthest corner.
+type GradientDesc struct {
+	Type    string         `json:"type"`
+	Angle   float64        `json:"angle"`
+	CenterX *float64       `json:"cx"`
+	CenterY *float64       `json:"cy"`
+	Radius  float64        `json:"radius"`
+	Stops   []GradientStop `json:"stops"`
+}
+
+// GradientStop is a color at an offset in [0, 1] along the gradient. Offsets
+// must not decrease.
+type GradientStop struct {
+	Offset float64  `json:"offset"`
+	Color  []uint32 `json:"color"`
+}
+
+func validGradient(g *GradientDesc) bool {
+	if g == nil {
+		return true
+	}
+	if g.Type != gradientLinear && g.Type != gradientRadial || len(g.Stops) == 0 || g.Radius < 0 {
+		return false
+	}
+	for i, s := range g.Stops {
+		if s.Offset < 0 || s.Offset > 1 || i > 0 && s.Offset < g.Stops[i-1].Offset {
+			return false
+		}
+		if len(s.Color) != 3 && len(s.Color) != 4 {
+			return false
+		}
+	}
+	return true
+}
+
+// gradientColor interpolates the premultiplied stop colors at t, clamping
+// before the first and after the last stop.
+func gradientColor(stops []GradientStop, cols [][4]float64, t float64) [4]float64 {
+	if t <= stops[0].Offset {
+		return cols[0]
+	}
+	for i := 1; i < len(stops); i++ {
+		if t <= stops[i].Offset {
+			span := stops[i].Offset - stops[i-1].Offset
+			if span <= 0 {
+				return cols[i]
+			}
+			f := (t - stops[i-1].Offset) / span
+			var c [4]float64
+			for k := range c {
+				c[k] = cols[i-1][k]*(1-f) + cols[i][k]*f
+			}
+			return c
+		}
+	}
+	return cols[len(cols)-1]
+}
+
+// GradientImage rasterizes a gradient into a w x h image. Colors are
+// interpolated on premultiplied alpha like in CSS, so fading to transparent
+// doesn't darken.
+func GradientImage(g *GradientDesc, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	cols := make([][4]float64, len(g.Stops))
+	for i, s := range g.Stops {
+		a := 255.0
+		if len(s.Color) == 4 {
+			a = float64(minInt(int(s.Color[3]), 255))
+		}
+		for k := 0; k < 3; k++ {
+			cols[i][k] = float64(minInt(int(s.Color[k]), 255)) * a / 255
+		}
+		cols[i][3] = a
+	}
+
+	fw, fh := float64(w), float64(h)
+	var at func(px, py float64) float64
+	switch g.Type {
+	case gradientRadial:
+		cx, cy := fw/2, fh/2
+		if g.CenterX != nil {
+			cx = *g.CenterX * fw
+		}
+		if g.CenterY != nil {
+			cy = *g.CenterY * fh
+		}
+		r := g.Radius
+		if r == 0 {
+			r = math.Hypot(math.Max(cx, fw-cx), math.Max(cy, fh-cy))
+		}
+		at = func(px, py float64) float64 {
+			if r == 0 {
+				return 1
+			}
+			return math.Hypot(px-cx, py-cy) / r
+		}
+	default:
+		rad := g.Angle * math.Pi / 180
+		dx, dy := math.Sin(rad), -math.Cos(rad)
+		// the gradient line is long enough for the corners to get the end colors
+		l := math.Abs(fw*dx) + math.Abs(fh*dy)
+		at = func(px, py float64) float64 {
+			if l == 0 {
+				return 0
+			}
+			return ((px-fw/2)*dx+(py-fh/2)*dy)/l + 0.5
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := gradientColor(g.Stops, cols, at(float64(x)+0.5, float64(y)+0.5))
+			o := dst.PixOffset(x, y)
+			for k := 0; k < 4; k++ {
+				dst.Pix[o+k] = uint8(c[k] + 0.5)
+			}
+		}
+	}
+	return dst
+}
+
+// fillCoverage colors an image drawn in opaque white with a fill, using its
+// alpha as coverage. off is the position of img in the fill; pixels beyond
+// the fill take the color of its nearest edge.
+func fillCoverage(img *image.RGBA, fill *image.RGBA, off image.Point) {
+	fb := fill.Bounds()
+	if fb.Empty() {
+		return
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		fy := minInt(maxInt(y-b.Min.Y+off.Y, fb.Min.Y), fb.Max.Y-1)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			o := img.PixOffset(x, y)
+			a := uint32(img.Pix[o+3])
+			if a == 0 {
+				continue
+			}
+			fx := minInt(maxInt(x-b.Min.X+off.X, fb.Min.X), fb.Max.X-1)
+			f := fill.PixOffset(fx, fy)
+			for k := 0; k < 4; k++ {
+				img.Pix[o+k] = uint8((uint32(fill.Pix[f+k])*a + 127) / 255)
+			}
+		}
+	}
+}
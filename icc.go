@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+var iccJPEGHeader = []byte("ICC_PROFILE\x00")
+
+// srgbFromD50 converts D50 adapted XYZ, the ICC profile connection space, to
+// linear sRGB. It is the inverse of the colorants of the ICC sRGB profile.
+var srgbFromD50 = invert3([3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+})
+
+// ICCProfile is the part of an RGB matrix/TRC profile needed to convert to
+// sRGB: the colorants, mapping linear RGB to D50 XYZ, and the tone curves of
+// the channels as lookup tables from 8-bit values to linear light.
+type ICCProfile struct {
+	Name   string
+	Matrix [3][3]float64
+	Curves [3][256]float64
+}
+
+// iccProfileData returns the embedded ICC profile of a JPEG, PNG or WebP
+// stream, or nil.
+func iccProfileData(src []byte, format string) []byte {
+	switch format {
+	case "jpeg":
+		segs, _, ok := splitJPEG(src)
+		if !ok {
+			return nil
+		}
+		// profiles larger than a segment are split into numbered chunks
+		chunks := make(map[int][]byte)
+		for _, s := range segs {
+			if s.Marker == 0xe2 && len(s.Data) > len(iccJPEGHeader)+2 && bytes.HasPrefix(s.Data, iccJPEGHeader) {
+				chunks[int(s.Data[len(iccJPEGHeader)])] = s.Data[len(iccJPEGHeader)+2:]
+			}
+		}
+		seqs := make([]int, 0, len(chunks))
+		for n := range chunks {
+			seqs = append(seqs, n)
+		}
+		sort.Ints(seqs)
+		var data []byte
+		for _, n := range seqs {
+			data = append(data, chunks[n]...)
+		}
+		return data
+	case "png":
+		chunks, err := pngChunks(src)
+		if err != nil {
+			return nil
+		}
+		for _, c := range chunks {
+			if c.Type != "iCCP" {
+				continue
+			}
+			i := bytes.IndexByte(c.Data, 0)
+			if i < 0 || i+2 > len(c.Data) {
+				return nil
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(c.Data[i+2:]))
+			if err != nil {
+				return nil
+			}
+			data, err := ioutil.ReadAll(zr)
+			if err != nil {
+				return nil
+			}
+			return data
+		}
+	case "webp":
+		for _, c := range riffChunks(src) {
+			if c.ID == "ICCP" {
+				return c.Data
+			}
+		}
+	}
+	return nil
+}
+
+type iccTag struct {
+	sig  string
+	data []byte
+}
+
+// ParseICCProfile reads an RGB matrix/TRC profile. Profiles of other color
+// spaces or LUT based profiles are not supported.
+func ParseICCProfile(data []byte) (*ICCProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("icc: invalid profile")
+	}
+	tags := make(map[string][]byte)
+	n := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < n && 132+i*12+12 <= len(data); i++ {
+		e := data[132+i*12:]
+		off, size := int(binary.BigEndian.Uint32(e[4:])), int(binary.BigEndian.Uint32(e[8:]))
+		if off < 0 || size < 0 || off+size > len(data) {
+			return nil, errors.New("icc: invalid tag table")
+		}
+		tags[string(e[:4])] = data[off : off+size]
+	}
+
+	p := &ICCProfile{Name: iccDescription(tags["desc"])}
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return p, errors.New("icc: not an RGB profile")
+	}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz := tags[sig]
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return p, errors.New("icc: missing colorants")
+		}
+		for j := 0; j < 3; j++ {
+			p.Matrix[j][i] = s15Fixed16(xyz[8+j*4:])
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := iccCurve(tags[sig])
+		if err != nil {
+			return p, err
+		}
+		for v := range p.Curves[i] {
+			p.Curves[i][v] = curve(float64(v) / 255)
+		}
+	}
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// iccDescription reads a textDescriptionType (v2) or the first record of a
+// multiLocalizedUnicodeType (v4) tag.
+func iccDescription(t []byte) string {
+	switch {
+	case len(t) >= 12 && string(t[:4]) == "desc":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		if n > len(t)-12 {
+			n = len(t) - 12
+		}
+		return strings.TrimRight(string(t[12:12+n]), "\x00")
+	case len(t) >= 28 && string(t[:4]) == "mluc":
+		n, off := int(binary.BigEndian.Uint32(t[20:])), int(binary.BigEndian.Uint32(t[24:]))
+		if off < 0 || n < 0 || off+n > len(t) {
+			return ""
+		}
+		u := make([]uint16, n/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(t[off+i*2:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return ""
+}
+
+// iccCurve returns the tone curve of a curveType or parametricCurveType tag
+// as a function from encoded values to linear light, both in [0, 1].
+func iccCurve(t []byte) (func(float64) float64, error) {
+	if len(t) < 12 {
+		return nil, errors.New("icc: missing tone curve")
+	}
+	switch string(t[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		if len(t) < 12+2*n {
+			return nil, errors.New("icc: truncated tone curve")
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			g := float64(binary.BigEndian.Uint16(t[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, g) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(t[12+2*i:])) / 65535
+		}
+		return func(v float64) float64 {
+			pos := v * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			f := pos - float64(i)
+			return table[i]*(1-f) + table[i+1]*f
+		}, nil
+	case "para":
+		typ := binary.BigEndian.Uint16(t[8:])
+		counts := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		n, ok := counts[typ]
+		if !ok || len(t) < 12+4*n {
+			return nil, errors.New("icc: unsupported parametric curve")
+		}
+		var pr [7]float64
+		for i := 0; i < n; i++ {
+			pr[i] = s15Fixed16(t[12+4*i:])
+		}
+		g, a, b, c, d, e, f := pr[0], pr[1], pr[2], pr[3], pr[4], pr[5], pr[6]
+		pow := func(v float64) float64 { return math.Pow(math.Max(v, 0), g) }
+		switch typ {
+		case 0:
+			return pow, nil
+		case 1:
+			return func(v float64) float64 {
+				if v >= -b/a {
+					return pow(a*v + b)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(v float64) float64 {
+				if v >= -b/a {
+					return pow(a*v+b) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(v float64) float64 {
+				if v >= d {
+					return pow(a*v + b)
+				}
+				return c * v
+			}, nil
+		}
+		return func(v float64) float64 {
+			if v >= d {
+				return pow(a*v+b) + e
+			}
+			return c*v + f
+		}, nil
+	}
+	return nil, errors.New("icc: unsupported tone curve")
+}
+
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var r [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			r[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return r
+}
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var r [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				r[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return r
+}
+
+// IsSRGB reports whether converting with the profile would not change the
+// pixels noticeably.
+func (p *ICCProfile) IsSRGB() bool {
+	m := mul3(srgbFromD50, p.Matrix)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			id := 0.0
+			if i == j {
+				id = 1
+			}
+			if math.Abs(m[i][j]-id) > 0.002 {
+				return false
+			}
+		}
+		for v := range p.Curves[i] {
+			if math.Abs(p.Curves[i][v]-float64(srgbDecode[v])) > 0.002 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ToSRGB converts an image in the color space of the profile to sRGB.
+// Colors outside of the sRGB gamut are clipped.
+func (p *ICCProfile) ToSRGB(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(b.Sub(b.Min))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	m := mul3(srgbFromD50, p.Matrix)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		px := dst.Pix[i : i+4 : i+4]
+		r, g, bl := p.Curves[0][px[0]], p.Curves[1][px[1]], p.Curves[2][px[2]]
+		for c := 0; c < 3; c++ {
+			v := clampUnit(float32(m[c][0]*r + m[c][1]*g + m[c][2]*bl))
+			px[c] = srgbEncode[int(v*srgbEncodeSteps+0.5)]
+		}
+	}
+	return dst
+}
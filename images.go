@@ -4,32 +4,27 @@ import (
 	"bytes"
 	"errors"
 	"image"
+	"image/draw"
 	_ "image/gif"
-	_ "image/jpeg"
+	"image/jpeg"
 	"image/png"
 	_ "image/png"
 	"io/ioutil"
-	"math"
 	"os"
+	"strconv"
 
-	"github.com/nfnt/resize"
+	"github.com/disintegration/gift"
 	_ "golang.org/x/image/webp"
 )
 
-var Tsizes = map[string]int{
-	"s0": 1024,
-	"s1": 4096,
-	"s2": 9216,
-	"s3": 25600,
-	"s4": 65536,
-	"s5": 193600,
-	"s6": 577600,
-	"s7": 1721344,
-	"s8": 5062500,
-	"s9": 14745600,
-}
+const defaultTextureQuality = 85
+
+// posterFull is the key of full size posters in RequestsHandler.ImPathP
+const posterFull = "F"
 
-var Tprecalcs = [...]string{"s2", "s3", "s4", "s5", "s6"}
+// photoColorRatio is the share of distinct colors among sampled pixels above
+// which an image is considered photographic rather than flat artwork.
+const photoColorRatio = 0.25
 
 func (x *RequestsHandler) WriteToF(img image.Image) (error, string) {
 	var w bytes.Buffer
@@ -37,19 +32,130 @@ func (x *RequestsHandler) WriteToF(img image.Image) (error, string) {
 	if err != nil {
 		return err, ""
 	}
-	body := w.Bytes()
+	return x.WriteBytesToF(w.Bytes())
+}
+
+func (x *RequestsHandler) WriteJPEGToF(img image.Image, quality int) (error, string) {
+	var w bytes.Buffer
+	err := jpeg.Encode(&w, img, &jpeg.Options{Quality: quality})
+	if err != nil {
+		return err, ""
+	}
+	return x.WriteBytesToF(w.Bytes())
+}
+
+// WriteBytesToF stores already encoded image data under its content hash.
+func (x *RequestsHandler) WriteBytesToF(body []byte) (error, string) {
 	ID := GetMD5HashByte(body)
 	return x.SaveWriteToFile(x.ImPathF+ID, body), ID
 }
 
 func (x *RequestsHandler) WriteToScaled(base string, img image.Image, rsize string) error {
-	if size, ok := Tsizes[rsize]; ok {
-		return x.SaveWriteToPNG(x.ImPathS[rsize]+base, DownSampleTo(img, size))
+	return x.WriteToScaledQuality(base, img, rsize, x.textureQuality(base))
+}
+
+// textureQuality returns the JPEG quality for the textures of an image: the
+// one stored with the image, else the configured one.
+func (x *RequestsHandler) textureQuality(ID string) int {
+	if am, err := x.LoadAssetMeta(ID); !check_error(err) && am.Quality > 0 {
+		return am.Quality
+	}
+	return x.Quality
+}
+
+// SetTextureQuality stores the JPEG quality used for all textures of an image
+// and returns the quality to use. For 0 nothing is stored. As images are
+// stored by content, the quality is shared by everyone uploading the same
+// image and the last one set wins. If it changes, textures made with the old
+// one are dropped, they are recreated on demand.
+func (x *RequestsHandler) SetTextureQuality(ID string, quality int) (int, error) {
+	old := x.textureQuality(ID)
+	if quality == 0 || quality == old {
+		return old, nil
+	}
+	if _, err := x.UpdateAssetMeta(ID, func(m *AssetMeta) { m.Quality = quality }); err != nil {
+		return 0, err
+	}
+	x.dropTextures(ID)
+	return quality, nil
+}
+
+// dropTextures removes the stored textures, posters, KTX2 textures and mips
+// of an image.
+func (x *RequestsHandler) dropTextures(ID string) {
+	var paths []string
+	for rs := range x.Tsizes {
+		paths = append(paths, x.ImPathS[rs]+ID, x.ImPathP[rs]+ID, x.ImPathKTX2[rs]+ID)
+		x.ImageMapS[rs].Remove(ID)
+		x.ImageMapP.Remove(rs + "/" + ID)
+		x.ImageMapKTX2.Remove(rs + "/" + ID)
+	}
+	for _, mode := range mipModes {
+		for level := 0; level <= maxMipLevel; level++ {
+			paths = append(paths, x.mipPath(mode, level)+ID)
+			x.ImageMapMip.Remove(mode + "/" + strconv.Itoa(level) + "/" + ID)
+		}
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); !os.IsNotExist(err) {
+			check_error(err)
+		}
+	}
+}
+
+// WriteToScaledQuality stores the downscaled texture, picking JPEG with the
+// given quality for opaque photographic images and PNG for everything else.
+// Normal maps are always stored as PNG.
+func (x *RequestsHandler) WriteToScaledQuality(base string, img image.Image, rsize string, quality int) error {
+	if size, ok := x.Tsizes[rsize]; ok {
+		if x.isNormalMap(base) {
+			return x.SaveWriteToPNG(x.ImPathS[rsize]+base, DownSampleNormals(img, size, x.textureFilter(base, size)))
+		}
+		return x.SaveWriteTexture(x.ImPathS[rsize]+base, DownSampleTo(img, size, x.textureFilter(base, size)), quality)
 	}
 	return errors.New("Not such size defined in the size map")
 
 }
 
+// WriteAnimationScaled stores an animated texture by downscaling every frame.
+func (x *RequestsHandler) WriteAnimationScaled(base string, anim *Animation, rsize string) error {
+	size, ok := x.Tsizes[rsize]
+	if !ok {
+		return errors.New("Not such size defined in the size map")
+	}
+	scaled := &Animation{Delays: anim.Delays, LoopCount: anim.LoopCount, Format: anim.Format}
+	filter := x.textureFilter(base, size)
+	for _, f := range anim.Frames {
+		img := DownSampleTo(f, size, filter)
+		sf := image.NewRGBA(img.Bounds())
+		draw.Draw(sf, sf.Bounds(), img, img.Bounds().Min, draw.Src)
+		scaled.Frames = append(scaled.Frames, sf)
+	}
+	var w bytes.Buffer
+	if err := encodeAnimation(&w, scaled); err != nil {
+		return err
+	}
+	return x.SaveWriteToFile(x.ImPathS[rsize]+base, w.Bytes())
+}
+
+func (x *RequestsHandler) SaveWriteTexture(fname string, img image.Image, quality int) error {
+	if isOpaque(img) && isPhotographic(img) {
+		return x.SaveWriteToJPEG(fname, img, quality)
+	}
+	return x.SaveWriteToPNG(fname, img)
+}
+
+func (x *RequestsHandler) SaveWriteToJPEG(fname string, img image.Image, quality int) error {
+	if quality < 1 || quality > 100 {
+		quality = defaultTextureQuality
+	}
+	var w bytes.Buffer
+	if err := jpeg.Encode(&w, img, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	return x.SaveWriteToFile(fname, w.Bytes())
+}
+
 func (x *RequestsHandler) SaveWriteToPNG(fname string, img image.Image) error {
 	tfilename := fname + ".tmp"
 
@@ -84,27 +190,87 @@ func (x *RequestsHandler) SaveWriteToFile(fname string, data []byte) error {
 	return nil
 }
 
-func (x *RequestsHandler) ProcessImage(src []byte) (error, string) {
+// ProcessImage stores an uploaded image and precalculates its textures.
+// GIF, JPEG and animated PNG/WebP uploads are kept as-is, SVGs are sanitized,
+// everything else is re-encoded to PNG. Animations get animated textures plus first frame posters.
+// EXIF orientation is applied to the pixels and EXIF metadata is never stored.
+// Still images with an embedded ICC profile are converted to sRGB.
+// Quality and filter are stored with the image for textures made later. A
+// quality of 0 keeps the stored or configured JPEG quality, an empty filter
+// the filter of each texture size. Uploading an image again with a different
+// quality or filter replaces its textures for all users of the image.
+func (x *RequestsHandler) ProcessImage(src []byte, quality int, filter string) (error, string) {
+	if isSVG(src) {
+		return x.ProcessSVG(src)
+	}
+	anim, err := decodeAnimation(src, animationFormat(src))
+	if err != nil {
+		return err, ""
+	}
+	if anim != nil {
+		return x.processAnimation(src, anim, quality, filter)
+	}
+
 	img, format, err := image.Decode(bytes.NewReader(src))
 	if err != nil {
 		return err, ""
 	}
 	L().Info("Incoming image:", format)
 
+	orientation := exifOrientation(src, format)
+	if orientation > 1 {
+		L().Debug("EXIF orientation:", orientation)
+		img = applyOrientation(img, orientation)
+	}
+
+	profile, converted := "", false
+	if data := iccProfileData(src, format); data != nil {
+		icc, err := ParseICCProfile(data)
+		if icc != nil {
+			profile = icc.Name
+		}
+		switch {
+		case err != nil:
+			L().Debug("ICC profile not converted:", profile, err)
+		case !icc.IsSRGB():
+			L().Debug("ICC profile:", profile)
+			img = icc.ToSRGB(img)
+			converted = true
+		}
+	}
+
 	var ID string
-	if format == "gif" {
-		ID = GetMD5HashByte(src)
-		err = x.SaveWriteToFile(x.ImPathF+ID, src)
-	} else {
+	switch {
+	case format == "gif":
+		err, ID = x.WriteBytesToF(stripMetadata(src, format))
+	case format == "jpeg" && (orientation > 1 || converted):
+		err, ID = x.WriteJPEGToF(img, jpegStoreQuality)
+	case format == "jpeg":
+		err, ID = x.WriteBytesToF(stripMetadata(src, format))
+	default:
 		err, ID = x.WriteToF(img)
 	}
 
 	if err != nil {
 		return err, ""
 	}
+	if _, err = x.WriteImageMeta(ID, img); err != nil {
+		return err, ""
+	}
+	if err = x.SetTextureFilter(ID, filter); err != nil {
+		return err, ""
+	}
+	if quality, err = x.SetTextureQuality(ID, quality); err != nil {
+		return err, ""
+	}
+	if profile != "" {
+		if _, err = x.UpdateAssetMeta(ID, func(m *AssetMeta) { m.ICCProfile = profile }); err != nil {
+			return err, ""
+		}
+	}
 
-	for _, v := range Tprecalcs {
-		if err = x.WriteToScaled(ID, img, v); err != nil {
+	for _, v := range x.Tprecalcs {
+		if err = x.WriteToScaledQuality(ID, img, v, quality); err != nil {
 			return err, ""
 		}
 	}
@@ -114,15 +280,107 @@ func (x *RequestsHandler) ProcessImage(src []byte) (error, string) {
 
 }
 
-func DownSampleTo(img image.Image, NewPixelCount int) image.Image {
-	ox := float64(img.Bounds().Max.X)
-	oy := float64(img.Bounds().Max.Y)
+func (x *RequestsHandler) processAnimation(src []byte, anim *Animation, quality int, filter string) (error, string) {
+	L().Info("Incoming animation:", animationFormat(src), len(anim.Frames))
+	err, ID := x.WriteBytesToF(stripMetadata(src, animationFormat(src)))
+	if err != nil {
+		return err, ""
+	}
+	if quality, err = x.SetTextureQuality(ID, quality); err != nil {
+		return err, ""
+	}
+	if err = x.WritePoster(ID, anim.Frames[0], "", quality); err != nil {
+		return err, ""
+	}
+	if _, err = x.WriteImageMeta(ID, anim.Frames[0]); err != nil {
+		return err, ""
+	}
+	if err = x.SetTextureFilter(ID, filter); err != nil {
+		return err, ""
+	}
+	for _, v := range x.Tprecalcs {
+		if err = x.WriteAnimationScaled(ID, anim, v); err != nil {
+			return err, ""
+		}
+		if err = x.WritePoster(ID, anim.Frames[0], v, quality); err != nil {
+			return err, ""
+		}
+	}
+	L().Info("Hash:", ID)
+	return nil, ID
+}
 
-	scl := math.Sqrt(float64(NewPixelCount) / (ox * oy))
+// WritePoster stores the first frame of an animation, in full size for an
+// empty rsize or as a still texture otherwise.
+func (x *RequestsHandler) WritePoster(base string, img image.Image, rsize string, quality int) error {
+	if rsize == "" {
+		return x.SaveWriteToPNG(x.ImPathP[posterFull]+base, img)
+	}
+	if size, ok := x.Tsizes[rsize]; ok {
+		return x.SaveWriteTexture(x.ImPathP[rsize]+base, DownSampleTo(img, size, x.textureFilter(base, size)), quality)
+	}
+	return errors.New("Not such size defined in the size map")
+}
 
-	nx := uint(math.Round(ox * scl))
-	ny := uint(math.Round(oy * scl))
+// LoadFull decodes a stored full image. Animations yield their first frame.
+func (x *RequestsHandler) LoadFull(ID string) (image.Image, error) {
+	src, err := ioutil.ReadFile(x.ImPathF + ID)
+	if err != nil {
+		return nil, err
+	}
+	anim, err := decodeAnimation(src, animationFormat(src))
+	if err != nil {
+		return nil, err
+	}
+	if anim != nil {
+		return anim.Frames[0], nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(src))
+	return img, err
+}
 
-	imgout := resize.Thumbnail(nx, ny, img, resize.Bilinear)
+// DownSampleTo scales an image down to the size of a texture bucket. Images
+// smaller than the bucket are kept.
+func DownSampleTo(img image.Image, b *TextureBucket, filter gift.Resampling) image.Image {
+	nx, ny := b.ScaledSize(img.Bounds().Dx(), img.Bounds().Dy())
+	imgout := resampleToFit(img, nx, ny, filter)
 	return imgout
 }
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isPhotographic samples the image on a coarse grid and reports whether most
+// of the samples have distinct colors, which is typical for photos and rare
+// for rendered frames with flat fills and text.
+func isPhotographic(img image.Image) bool {
+	const grid = 64
+	b := img.Bounds()
+	if b.Empty() {
+		return false
+	}
+	stepX := (b.Dx() + grid - 1) / grid
+	stepY := (b.Dy() + grid - 1) / grid
+	colors := make(map[uint32]bool)
+	samples := 0
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			colors[(r>>11)<<10|(g>>11)<<5|bl>>11] = true
+			samples++
+		}
+	}
+	return float64(len(colors)) > float64(samples)*photoColorRatio
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// photoTestImage is an opaque image of gradients with noise, stored as JPEG
+// when scaled into a texture.
+func photoTestImage(w, h int) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8(rnd.Intn(256)), 255})
+		}
+	}
+	return img
+}
+
+// TestTextureQualityOverride checks that uploading an image again with
+// another quality replaces the textures made with the old one.
+func TestTextureQualityOverride(t *testing.T) {
+	x := newTestHandler(t)
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, photoTestImage(300, 200)); err != nil {
+		t.Fatal(err)
+	}
+	rs := x.Tprecalcs[0]
+	upload := func(quality int) (string, []byte) {
+		t.Helper()
+		err, ID := x.ProcessImage(enc.Bytes(), quality, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(x.ImPathS[rs] + ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+			t.Fatal("texture is not a JPEG")
+		}
+		return ID, data
+	}
+
+	ID, low := upload(30)
+	if _, fpath := x.presentKTX2(&ID, rs); fpath == nil || !fileExists(*fpath) {
+		t.Fatal("no KTX2 texture")
+	}
+
+	ID2, high := upload(95)
+	if ID2 != ID {
+		t.Fatalf("hash changed from %s to %s", ID, ID2)
+	}
+	if q := x.textureQuality(ID); q != 95 {
+		t.Errorf("stored quality %d, want 95", q)
+	}
+	if len(high) <= len(low) {
+		t.Errorf("texture not re-encoded: %d bytes at 30, %d at 95", len(low), len(high))
+	}
+	if fileExists(x.ImPathKTX2[rs]+ID) || x.ImageMapKTX2.Contains(rs+"/"+ID) {
+		t.Error("KTX2 texture of the old quality kept")
+	}
+	// uploading without a quality keeps the stored one
+	upload(0)
+	if q := x.textureQuality(ID); q != 95 {
+		t.Errorf("stored quality %d after upload without quality", q)
+	}
+}
+
+// TestTextureFilterChange checks that changing the filter of an image
+// replaces the textures made with the old one, precalculated or not.
+func TestTextureFilterChange(t *testing.T) {
+	x := newTestHandler(t)
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, photoTestImage(300, 200)); err != nil {
+		t.Fatal(err)
+	}
+	rs := x.Tprecalcs[0]
+	other := "s1"
+	err, ID := x.ProcessImage(enc.Bytes(), 0, "nearest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(x.ImPathS[rs] + ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, fpath := x.presentTexture(&ID, other); fpath == nil || !fileExists(*fpath) {
+		t.Fatalf("no texture of size %s", other)
+	}
+
+	if err, _ = x.ProcessImage(enc.Bytes(), 0, "lanczos"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(x.ImPathS[rs] + ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Error("precalculated texture kept")
+	}
+	if fileExists(x.ImPathS[other]+ID) || x.ImageMapS[other].Contains(ID) {
+		t.Errorf("texture of size %s kept", other)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+	"sort"
+)
+
+var ktx2Identifier = []byte{0xAB, 'K', 'T', 'X', ' ', '2', '0', 0xBB, '\r', '\n', 0x1A, '\n'}
+
+const (
+	ktx2MIME = "image/ktx2"
+
+	vkFormatR8G8B8A8UNORM = 37
+	vkFormatR8G8B8A8SRGB  = 43
+
+	// ktx2SupercompressionNone is the only scheme written so far; level data
+	// is stored as is and its byte length equals the uncompressed length.
+	ktx2SupercompressionNone = 0
+
+	ktx2HeaderSize = 12 + 9*4 + 4*4 + 2*8
+	ktx2LevelSize  = 3 * 8
+
+	// data format descriptor values, see the Khronos Data Format Specification
+	dfdModelRGBSDA      = 1
+	dfdPrimariesBT709   = 1
+	dfdTransferLinear   = 1
+	dfdTransferSRGB     = 2
+	dfdChannelR         = 0
+	dfdChannelG         = 1
+	dfdChannelB         = 2
+	dfdChannelA         = 15
+	dfdQualifierLinear  = 0x10
+	dfdBasicHeaderSize  = 24
+	dfdBasicSampleSize  = 16
+	ktx2WriterName      = "media-manager"
+	ktx2OrientationDown = "rd"
+)
+
+// ktx2Level is the data of one mip level as stored in the container.
+type ktx2Level struct {
+	Data []byte
+	// UncompressedLength differs from len(Data) once supercompression is used
+	UncompressedLength int
+}
+
+// ktx2RGBA8DFD returns the data format descriptor of R8G8B8A8 with straight
+// alpha, R8G8B8A8_SRGB for the sRGB transfer and R8G8B8A8_UNORM for the
+// linear one.
+func ktx2RGBA8DFD(transfer uint8) []byte {
+	var b bytes.Buffer
+	size := dfdBasicHeaderSize + 4*dfdBasicSampleSize
+	le := func(v interface{}) { binary.Write(&b, binary.LittleEndian, v) }
+	le(uint32(4 + size)) // dfdTotalSize
+	le(uint32(0))        // vendor and descriptor type: Khronos basic
+	le(uint16(2))        // version
+	le(uint16(size))
+	b.Write([]byte{dfdModelRGBSDA, dfdPrimariesBT709, transfer, 0})
+	b.Write([]byte{0, 0, 0, 0})             // texel block 1x1x1x1
+	b.Write([]byte{4, 0, 0, 0, 0, 0, 0, 0}) // bytes per plane
+	for i, ch := range []uint8{dfdChannelR, dfdChannelG, dfdChannelB, dfdChannelA} {
+		typ := ch
+		if ch == dfdChannelA {
+			typ |= dfdQualifierLinear
+		}
+		le(uint16(i * 8)) // bit offset
+		b.Write([]byte{7, typ})
+		le(uint32(0))   // sample position
+		le(uint32(0))   // lower
+		le(uint32(255)) // upper
+	}
+	return b.Bytes()
+}
+
+// ktx2KeyValues encodes the key/value data, sorted by key as required.
+func ktx2KeyValues(kv map[string]string) []byte {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		entry := append(append([]byte(k), 0), kv[k]...)
+		entry = append(entry, 0)
+		binary.Write(&b, binary.LittleEndian, uint32(len(entry)))
+		b.Write(entry)
+		for b.Len()%4 != 0 {
+			b.WriteByte(0)
+		}
+	}
+	return b.Bytes()
+}
+
+// encodeKTX2 writes a 2D RGBA8 KTX2 container in the given format, sRGB or
+// UNORM. levels holds the mip chain from the full size down, as the level
+// index does; the data itself is laid out smallest level first.
+func encodeKTX2(w io.Writer, width, height int, format, scheme uint32, levels []ktx2Level) error {
+	if len(levels) == 0 {
+		return errors.New("ktx2: no levels")
+	}
+	transfer := uint8(dfdTransferSRGB)
+	if format == vkFormatR8G8B8A8UNORM {
+		transfer = dfdTransferLinear
+	}
+	dfd := ktx2RGBA8DFD(transfer)
+	kvd := ktx2KeyValues(map[string]string{
+		"KTXorientation": ktx2OrientationDown,
+		"KTXwriter":      ktx2WriterName,
+	})
+
+	dfdOffset := ktx2HeaderSize + len(levels)*ktx2LevelSize
+	kvdOffset := dfdOffset + len(dfd)
+	offset := kvdOffset + len(kvd)
+	offsets := make([]int, len(levels))
+	for i := len(levels) - 1; i >= 0; i-- {
+		offset = (offset + 3) &^ 3
+		offsets[i] = offset
+		offset += len(levels[i].Data)
+	}
+
+	var b bytes.Buffer
+	le := func(v interface{}) { binary.Write(&b, binary.LittleEndian, v) }
+	b.Write(ktx2Identifier)
+	le([]uint32{format, 1, uint32(width), uint32(height), 0, 0, 1, uint32(len(levels)), scheme})
+	le([]uint32{uint32(dfdOffset), uint32(len(dfd)), uint32(kvdOffset), uint32(len(kvd))})
+	le([]uint64{0, 0}) // no supercompression global data
+	for i, l := range levels {
+		le([]uint64{uint64(offsets[i]), uint64(len(l.Data)), uint64(l.UncompressedLength)})
+	}
+	b.Write(dfd)
+	b.Write(kvd)
+	for i := len(levels) - 1; i >= 0; i-- {
+		for b.Len() < offsets[i] {
+			b.WriteByte(0)
+		}
+		b.Write(levels[i].Data)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// ktx2Size reads the dimensions from a KTX2 header.
+func ktx2Size(r io.Reader) (int, int, error) {
+	head := make([]byte, 12+4*4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(head[:12], ktx2Identifier) {
+		return 0, 0, errors.New("ktx2: bad identifier")
+	}
+	return int(binary.LittleEndian.Uint32(head[20:])), int(binary.LittleEndian.Uint32(head[24:])), nil
+}
+
+// rgba8Level returns the straight alpha RGBA8 bytes of a premultiplied image.
+func rgba8Level(img *image.RGBA) ktx2Level {
+	nimg := image.NewNRGBA(img.Bounds())
+	draw.Draw(nimg, nimg.Bounds(), img, img.Bounds().Min, draw.Src)
+	return ktx2Level{Data: nimg.Pix, UncompressedLength: len(nimg.Pix)}
+}
+
+// EncodeKTX2Texture writes an image as sRGB KTX2 with a full mip chain.
+func EncodeKTX2Texture(w io.Writer, img image.Image) error {
+	return encodeKTX2Chain(w, img, vkFormatR8G8B8A8SRGB, halveRGBA)
+}
+
+// EncodeKTX2NormalMap writes a normal map as UNORM KTX2 with a full mip
+// chain, renormalized on every level.
+func EncodeKTX2NormalMap(w io.Writer, img image.Image) error {
+	return encodeKTX2Chain(w, img, vkFormatR8G8B8A8UNORM, halveNormals)
+}
+
+func encodeKTX2Chain(w io.Writer, img image.Image, format uint32, halve func(*image.RGBA) *image.RGBA) error {
+	cur := image.NewRGBA(img.Bounds().Sub(img.Bounds().Min))
+	draw.Draw(cur, cur.Bounds(), img, img.Bounds().Min, draw.Src)
+	b := cur.Bounds()
+	var levels []ktx2Level
+	for {
+		levels = append(levels, rgba8Level(cur))
+		if cur.Bounds().Dx() == 1 && cur.Bounds().Dy() == 1 {
+			break
+		}
+		cur = halve(cur)
+	}
+	return encodeKTX2(w, b.Dx(), b.Dy(), format, ktx2SupercompressionNone, levels)
+}
+
+// WriteKTX2Scaled stores the texture of the given size as KTX2. Vector
+// sources are rasterized at the texture size, animations use their first
+// frame and normal maps are stored as UNORM.
+func (x *RequestsHandler) WriteKTX2Scaled(base string, rsize string) error {
+	size, ok := x.Tsizes[rsize]
+	if !ok {
+		return errors.New("Not such size defined in the size map")
+	}
+	var img image.Image
+	normal := x.isNormalMap(base)
+	if svg, ok := x.svgSource(base); ok {
+		w, h, err := svgSize(svg)
+		if err != nil {
+			return err
+		}
+		w, h = clampSVGSize(size.ScaledSize(w, h))
+		if img, err = rasterizeSVG(svg, w, h); err != nil {
+			return err
+		}
+	} else {
+		full, err := x.LoadFull(base)
+		if err != nil {
+			return err
+		}
+		if normal {
+			img = DownSampleNormals(full, size, x.textureFilter(base, size))
+		} else {
+			img = DownSampleTo(full, size, x.textureFilter(base, size))
+		}
+	}
+	var w bytes.Buffer
+	encode := EncodeKTX2Texture
+	if normal {
+		encode = EncodeKTX2NormalMap
+	}
+	if err := encode(&w, img); err != nil {
+		return err
+	}
+	return x.SaveWriteToFile(x.ImPathKTX2[rsize]+base, w.Bytes())
+}
+
+// presentKTX2 returns the KTX2 texture of an image, creating it on first use.
+func (x *RequestsHandler) presentKTX2(ID *string, rsize string) (*MetaDef, *string) {
+	key := rsize + "/" + *ID
+	fpath := x.ImPathKTX2[rsize] + *ID
+	if meta0, ok := x.ImageMapKTX2.Get(key); ok {
+		L().Debug(key + " is already in the map")
+		return meta0.(*MetaDef), &fpath
+	}
+
+	reader, err := os.Open(fpath)
+	if err != nil {
+		if res, _ := x.present(ID); res == nil {
+			return nil, nil
+		}
+		L().Debug(*ID + " : converting to ktx2")
+		if check_error(x.WriteKTX2Scaled(*ID, rsize)) {
+			return nil, nil
+		}
+		if reader, err = os.Open(fpath); check_error(err) {
+			return nil, nil
+		}
+	}
+	defer reader.Close()
+
+	meta := &MetaDef{mime: ktx2MIME}
+	if meta.W, meta.H, err = ktx2Size(reader); check_error(err) {
+		return nil, nil
+	}
+	if am, err := x.LoadAssetMeta(*ID); !check_error(err) {
+		meta.Placeholder = am.Placeholder
+		meta.Color = am.Color
+	}
+	x.ImageMapKTX2.Add(key, meta)
+	return meta, &fpath
+}
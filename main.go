@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
@@ -41,6 +42,18 @@ type FrameRenderRequest struct {
 type MetaDef struct {
 	H, W int
 	mime string
+	// Frames and Duration (ms) are only set for animated images
+	Frames   int
+	Duration int
+	// Placeholder and Color come from the stored AssetMeta
+	Placeholder string
+	Color       []uint32
+}
+
+type HashResponse struct {
+	Hash        string   `json:"hash"`
+	Placeholder string   `json:"placeholder,omitempty"`
+	Color       []uint32 `json:"color,omitempty"`
 }
 
 func check_error(err error) bool {
@@ -58,10 +71,36 @@ type RequestsHandler struct {
 	Audiopath string
 	ImPathF   string
 	ImPathS   map[string]string
+	Tsizes    map[string]*TextureBucket
+	Tprecalcs []string
 	ImageMapF *lru.Cache
 	ImageMapS map[string]*lru.Cache
+	ImPathP   map[string]string
+	ImageMapP *lru.Cache
+	ImPathSVG string
+	// SVGRasters tracks the rasterized SVGs by path
+	SVGRasters *lru.Cache
+	ImPathM    string
+	DHashes    *dHashIndex
+	// ImPathMip is keyed by mip mode, levels are subdirectories
+	ImPathMip   map[string]string
+	ImageMapMip *lru.Cache
+	MipMode     string
+	// ImPathKTX2 is keyed by texture size like ImPathS
+	ImPathKTX2   map[string]string
+	ImageMapKTX2 *lru.Cache
+	// ImPathCrop holds smart crops, named by hash and size, CropFiles limits
+	// how many of them are kept
+	ImPathCrop   string
+	ImageMapCrop *lru.Cache
+	CropKeys     *keyIndex
+	CropFiles    *lru.Cache
+	// PaletteSize is the number of palette colors if not requested otherwise
+	PaletteSize int
+	Quality     int
 	// ImageMap         map[string]bool
 	PresentMutex     sync.Mutex
+	MetaMutex        sync.Mutex
 	framesinprogress map[string]bool
 	RenderQueue      chan *FrameRenderRequest
 	RenderDone       chan *FrameRenderRequest
@@ -69,6 +108,17 @@ type RequestsHandler struct {
 
 const defaultCacheSize = 1024
 
+// newFileCache returns a cache of generated files keyed by their path, which
+// deletes the files it evicts.
+func newFileCache(size int) *lru.Cache {
+	c, _ := lru.NewWithEvict(size, func(key, _ interface{}) {
+		if err := os.Remove(key.(string)); !os.IsNotExist(err) {
+			check_error(err)
+		}
+	})
+	return c
+}
+
 var API_PREFIX = "/api/v3"
 
 func DefRequestsHandler(cfg *LocalConfig) *RequestsHandler {
@@ -76,6 +126,8 @@ func DefRequestsHandler(cfg *LocalConfig) *RequestsHandler {
 	x.Imagepath = strings.TrimSuffix(cfg.Imagepath, "/") + "/"
 	x.Audiopath = strings.TrimSuffix(cfg.Audiopath, "/") + "/"
 	x.Fontpath = strings.TrimSuffix(cfg.Fontpath, "/") + "/"
+	x.Quality = cfg.TextureQuality
+	x.PaletteSize = cfg.PaletteSize
 	x.framesinprogress = make(map[string]bool)
 	x.RenderQueue = make(chan *FrameRenderRequest, 512)
 	x.RenderDone = make(chan *FrameRenderRequest, 512)
@@ -85,17 +137,76 @@ func DefRequestsHandler(cfg *LocalConfig) *RequestsHandler {
 	os.MkdirAll(x.Imagepath+"F", os.ModePerm)
 	x.ImPathF = x.Imagepath + "F/"
 
+	if err := validateBuckets(cfg.TextureSizes, cfg.TexturePrecalcs, subdirsOf(cfg.Imagepath, cfg.Audiopath, cfg.Fontpath)); err != nil {
+		L().Fatal(errors.WithMessage(err, "invalid texture sizes"))
+	}
+	x.Tsizes = make(map[string]*TextureBucket)
+	for i := range cfg.TextureSizes {
+		x.Tsizes[cfg.TextureSizes[i].Name] = &cfg.TextureSizes[i]
+	}
+	x.Tprecalcs = cfg.TexturePrecalcs
+	recalc := x.migrateBuckets()
+
 	x.ImageMapF, _ = lru.New(defaultCacheSize)
 	x.ImageMapS = make(map[string]*lru.Cache)
 	x.ImPathS = make(map[string]string)
-	for rs := range Tsizes {
+	for rs := range x.Tsizes {
 		os.MkdirAll(x.Imagepath+rs, os.ModePerm)
 		x.ImPathS[rs] = x.Imagepath + rs + "/"
 		x.ImageMapS[rs], _ = lru.New(defaultCacheSize)
 	}
 
+	os.MkdirAll(x.Imagepath+"M", os.ModePerm)
+	x.ImPathM = x.Imagepath + "M/"
+	x.DHashes = newDHashIndex()
+
+	x.ImageMapKTX2, _ = lru.New(defaultCacheSize)
+	x.ImPathKTX2 = make(map[string]string)
+	for rs := range x.Tsizes {
+		x.ImPathKTX2[rs] = x.Imagepath + "ktx2/" + rs + "/"
+		os.MkdirAll(x.ImPathKTX2[rs], os.ModePerm)
+	}
+
+	x.MipMode = cfg.MipMode
+	if !isMipMode(x.MipMode) {
+		L().Warn("Unknown mip mode ", x.MipMode, ", using ", mipResize)
+		x.MipMode = mipResize
+	}
+	x.ImageMapMip, _ = lru.New(defaultCacheSize)
+	x.ImPathMip = make(map[string]string)
+	for _, mode := range mipModes {
+		x.ImPathMip[mode] = x.Imagepath + "mip/" + mode + "/"
+		for level := 0; level <= maxMipLevel; level++ {
+			os.MkdirAll(x.mipPath(mode, level), os.ModePerm)
+		}
+	}
+
+	os.MkdirAll(x.Imagepath+"svg", os.ModePerm)
+	x.ImPathSVG = x.Imagepath + "svg/"
+	x.SVGRasters = newFileCache(maxSVGRasters)
+	x.dropSVGRasters()
+
+	os.MkdirAll(x.Imagepath+"crop", os.ModePerm)
+	x.ImPathCrop = x.Imagepath + "crop/"
+	x.CropKeys = newKeyIndex()
+	x.ImageMapCrop = x.newCropMetaCache()
+	x.CropFiles = newFileCache(maxCropFiles)
+	x.dropSmartCrops()
+
+	x.ImageMapP, _ = lru.New(defaultCacheSize)
+	x.ImPathP = make(map[string]string)
+	for rs := range x.Tsizes {
+		x.ImPathP[rs] = x.Imagepath + "P/" + rs + "/"
+	}
+	x.ImPathP[posterFull] = x.Imagepath + "P/" + posterFull + "/"
+	for _, p := range x.ImPathP {
+		os.MkdirAll(p, os.ModePerm)
+	}
+
 	os.MkdirAll(strings.TrimSuffix(x.ImPathF, "/"), 0775)
 	go x.run()
+	go x.loadDHashIndex()
+	go x.precalcBuckets(recalc)
 	return x
 }
 
@@ -144,18 +255,7 @@ func (x *RequestsHandler) present(ID *string) (*MetaDef, *string) {
 	}
 
 	defer reader.Close()
-	im, format, err1 := image.DecodeConfig(reader)
-	meta := new(MetaDef)
-	if err1 != nil {
-		L().Debug("%s: %v\n", *ID, err1)
-		meta.mime = "image/png"
-	} else {
-		meta.H = im.Height
-		meta.W = im.Width
-		meta.mime = "image/" + format
-		L().Debug("%s %d %d\n", *ID, im.Width, im.Height)
-	}
-	L().Debug("Mime:", meta.mime)
+	meta := x.decodeMeta(reader, *ID)
 	x.ImageMapF.Add(*ID, meta)
 	return meta, &fpath
 
@@ -175,13 +275,9 @@ func (x *RequestsHandler) presentTexture(ID *string, rsize string) (*MetaDef, *s
 		converted := false
 		L().Debug(*ID + " : converting from full")
 		if meta, filepath := x.present(ID); meta != nil {
-			if reader, err = os.Open(*filepath); !check_error(err) {
-				if img, _, errl := image.Decode(reader); !check_error(errl) {
-					if err = x.WriteToScaled(*ID, img, rsize); !check_error(err) {
-						if reader, err = os.Open(fpath); err == nil {
-							converted = true
-						}
-					}
+			if err = x.convertFromFull(*ID, *filepath, meta, rsize); !check_error(err) {
+				if reader, err = os.Open(fpath); err == nil {
+					converted = true
 				}
 			}
 		}
@@ -192,20 +288,158 @@ func (x *RequestsHandler) presentTexture(ID *string, rsize string) (*MetaDef, *s
 	}
 
 	defer reader.Close()
+	meta := x.decodeMeta(reader, *ID)
+	x.ImageMapS[rsize].Add(*ID, meta)
+	return meta, &fpath
+}
+
+// decodeMeta reads dimensions, mime type and animation info of a stored image.
+func (x *RequestsHandler) decodeMeta(reader io.ReadSeeker, ID string) *MetaDef {
 	im, format, err1 := image.DecodeConfig(reader)
 	meta := new(MetaDef)
 	if err1 != nil {
-		L().Debug("%s: %v\n", *ID, err1)
+		L().Debug("%s: %v\n", ID, err1)
 		meta.mime = "image/png"
 	} else {
 		meta.H = im.Height
 		meta.W = im.Width
 		meta.mime = "image/" + format
-		L().Debug("%s %d %d\n", *ID, im.Width, im.Height)
+		L().Debug("%s %d %d\n", ID, im.Width, im.Height)
+		x.animationInfo(reader, format, meta)
+	}
+	if am, err := x.LoadAssetMeta(ID); !check_error(err) {
+		meta.Placeholder = am.Placeholder
+		meta.Color = am.Color
 	}
 	L().Debug("Mime:", meta.mime)
-	x.ImageMapS[rsize].Add(*ID, meta)
-	return meta, &fpath
+	return meta
+}
+
+// presentPoster returns the first frame of an animation, in full size or as a
+// still texture. Still images are their own poster.
+func (x *RequestsHandler) presentPoster(ID *string, rsize string) (*MetaDef, *string) {
+	meta, filepath := x.present(ID)
+	if meta == nil {
+		return nil, nil
+	}
+	if meta.Frames < 2 {
+		if rsize == posterFull {
+			return meta, filepath
+		}
+		return x.presentTexture(ID, rsize)
+	}
+
+	key := rsize + "/" + *ID
+	fpath := x.ImPathP[rsize] + *ID
+	if meta0, ok := x.ImageMapP.Get(key); ok {
+		L().Debug(key + " is already in the map")
+		return meta0.(*MetaDef), &fpath
+	}
+
+	reader, err := os.Open(fpath)
+	if err != nil {
+		L().Debug(*ID + " : extracting poster")
+		src, err := ioutil.ReadFile(*filepath)
+		if check_error(err) {
+			return nil, nil
+		}
+		anim, err := decodeAnimation(src, animationFormat(src))
+		if check_error(err) || anim == nil {
+			return nil, nil
+		}
+		prsize := rsize
+		if prsize == posterFull {
+			prsize = ""
+		}
+		if check_error(x.WritePoster(*ID, anim.Frames[0], prsize, x.textureQuality(*ID))) {
+			return nil, nil
+		}
+		if reader, err = os.Open(fpath); check_error(err) {
+			return nil, nil
+		}
+	}
+
+	defer reader.Close()
+	pmeta := x.decodeMeta(reader, *ID)
+	x.ImageMapP.Add(key, pmeta)
+	return pmeta, &fpath
+}
+
+// convertFromFull creates a missing texture from the stored full image.
+func (x *RequestsHandler) convertFromFull(ID string, filepath string, meta *MetaDef, rsize string) error {
+	if svg, ok := x.svgSource(ID); ok {
+		return x.WriteSVGScaled(ID, svg, rsize)
+	}
+	src, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+	if meta.Frames > 1 {
+		anim, err := decodeAnimation(src, animationFormat(src))
+		if err != nil {
+			return err
+		}
+		if anim != nil {
+			return x.WriteAnimationScaled(ID, anim, rsize)
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	return x.WriteToScaled(ID, img, rsize)
+}
+
+// animationInfo fills in frame count and duration of animated images.
+func (x *RequestsHandler) animationInfo(reader io.ReadSeeker, format string, meta *MetaDef) {
+	if format != "gif" && format != "png" && format != "webp" {
+		return
+	}
+	if _, err := reader.Seek(0, io.SeekStart); check_error(err) {
+		return
+	}
+	src, err := ioutil.ReadAll(reader)
+	if check_error(err) {
+		return
+	}
+	frames, duration := animationFrameInfo(src, format)
+	if frames > 1 {
+		meta.Frames = frames
+		meta.Duration = duration
+	}
+}
+
+// setMetaHeaders exposes image metadata as response headers.
+func setMetaHeaders(w http.ResponseWriter, res *MetaDef) {
+	w.Header().Set("Content-Type", res.mime)
+	w.Header().Set("x-height", strconv.Itoa(res.H))
+	w.Header().Set("x-width", strconv.Itoa(res.W))
+	if res.Frames > 1 {
+		w.Header().Set("x-frames", strconv.Itoa(res.Frames))
+		w.Header().Set("x-duration", strconv.Itoa(res.Duration))
+	}
+	if res.Placeholder != "" {
+		w.Header().Set("x-placeholder", res.Placeholder)
+	}
+	if len(res.Color) == 4 {
+		w.Header().Set("x-color", fmt.Sprintf("%d,%d,%d,%d", res.Color[0], res.Color[1], res.Color[2], res.Color[3]))
+	}
+}
+
+// writeHashResponse responds with the hash of a stored image together with
+// its placeholder.
+func (x *RequestsHandler) writeHashResponse(w http.ResponseWriter, hash string) {
+	resp := HashResponse{Hash: hash}
+	if am, err := x.LoadAssetMeta(hash); !check_error(err) {
+		resp.Placeholder = am.Placeholder
+		resp.Color = am.Color
+	}
+	body, err := json.Marshal(resp)
+	if check_error(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(body)
 }
 
 func homePage(w http.ResponseWriter, r *http.Request) {
@@ -227,13 +461,155 @@ func (x *RequestsHandler) getImage(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	w.Header().Set("Content-Type", res.mime)
-	w.Header().Set("x-height", strconv.Itoa(res.H))
-	w.Header().Set("x-width", strconv.Itoa(res.W))
+	query := r.URL.Query()
+	if crop := query.Get("crop"); crop != "" {
+		if !isCropMode(crop) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"crop\"}"))
+			return
+		}
+		cw, ch, ok := cropRequestSize(query.Get("width"), query.Get("height"))
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"size\"}"))
+			return
+		}
+		if res, filepath = x.presentSmartCrop(&(filename), cw, ch); res == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	} else if svg, ok := x.svgSource(filename); ok {
+		if query.Get("format") == "svg" {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Header().Set("Content-Security-Policy", svgCSP)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Write(svg)
+			return
+		}
+		if query.Get("width") != "" || query.Get("height") != "" {
+			rw, rh, err := svgRequestSize(res.W, res.H, query.Get("width"), query.Get("height"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("{\"Error\":\"size\"}"))
+				return
+			}
+			if res, filepath = x.presentSVGRaster(filename, rw, rh); res == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	setMetaHeaders(w, res)
 	http.ServeFile(w, r, *filepath)
 	L().Info("Endpoint Hit: Image served: %s %d", filename, (makeTimestamp() - tm1))
 }
 
+func (x *RequestsHandler) getPoster(w http.ResponseWriter, r *http.Request) {
+	tm1 := makeTimestamp()
+	rsize := chi.URLParam(r, "rsize")
+	filename := chi.URLParam(r, "file")
+
+	if rsize == "" {
+		rsize = posterFull
+	} else if _, ok := x.Tsizes[rsize]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	L().Debug("Endpoint Hit: Poster Get:", filename, rsize)
+
+	res, filepath := x.presentPoster(&(filename), rsize)
+	if res == nil {
+		http.NotFound(w, r)
+		return
+	}
+	setMetaHeaders(w, res)
+	http.ServeFile(w, r, *filepath)
+	L().Info("Endpoint Hit: Poster served: %s %d", filename, (makeTimestamp() - tm1))
+}
+
+type PaletteResponse struct {
+	Hash   string     `json:"hash"`
+	Colors [][]uint32 `json:"colors"`
+}
+
+func (x *RequestsHandler) getPalette(w http.ResponseWriter, r *http.Request) {
+	filename := chi.URLParam(r, "file")
+	L().Debug("Endpoint Hit: Palette Get:", filename)
+
+	count := x.PaletteSize
+	if c := r.URL.Query().Get("count"); c != "" {
+		var err error
+		count, err = strconv.Atoi(c)
+		if err != nil || count < 1 || count > maxPaletteSize {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"count\"}"))
+			return
+		}
+	}
+
+	if res, _ := x.present(&filename); res == nil {
+		http.NotFound(w, r)
+		return
+	}
+	colors, err := x.Palette(filename, count)
+	if err != nil {
+		sentry.CaptureException(err)
+		L().Error(fmt.Errorf("error during palette extraction: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(PaletteResponse{Hash: filename, Colors: colors})
+	if check_error(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	L().Info("Endpoint Hit: Palette served: %s", filename)
+}
+
+type SimilarResponse struct {
+	Hash    string         `json:"hash"`
+	Similar []SimilarImage `json:"similar"`
+}
+
+func (x *RequestsHandler) getSimilar(w http.ResponseWriter, r *http.Request) {
+	filename := chi.URLParam(r, "file")
+	L().Debug("Endpoint Hit: Similar Get:", filename)
+
+	maxdist := defaultSimilarDist
+	if d := r.URL.Query().Get("maxdist"); d != "" {
+		var err error
+		maxdist, err = strconv.Atoi(d)
+		if err != nil || maxdist < 0 || maxdist > maxSimilarDist {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"maxdist\"}"))
+			return
+		}
+	}
+
+	if res, _ := x.present(&filename); res == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h, err := x.imageDHash(filename)
+	if err != nil {
+		sentry.CaptureException(err)
+		L().Error(fmt.Errorf("error during difference hashing: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(SimilarResponse{Hash: filename, Similar: x.DHashes.Similar(filename, h, maxdist)})
+	if check_error(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	L().Info("Endpoint Hit: Similar served: %s", filename)
+}
+
 func (x *RequestsHandler) getTrack(w http.ResponseWriter, r *http.Request) {
 	filename := chi.URLParam(r, "file")
 
@@ -273,25 +649,70 @@ func (x *RequestsHandler) getTexture(w http.ResponseWriter, r *http.Request) {
 	rsize := chi.URLParam(r, "rsize")
 	filename := chi.URLParam(r, "file")
 
-	if _, ok := Tsizes[rsize]; !ok {
+	if _, ok := x.Tsizes[rsize]; !ok {
 		http.NotFound(w, r)
 		return
 	}
 
 	L().Debug("Endpoint Hit: Texture Get:", filename, rsize)
 
-	res, filepath := x.presentTexture(&(filename), rsize)
+	// KTX2 is picked explicitly or by content negotiation
+	w.Header().Set("Vary", "Accept")
+	var res *MetaDef
+	var filepath *string
+	switch format := r.URL.Query().Get("format"); {
+	case format == "ktx2" || format == "" && strings.Contains(r.Header.Get("Accept"), ktx2MIME):
+		res, filepath = x.presentKTX2(&(filename), rsize)
+	case format == "":
+		res, filepath = x.presentTexture(&(filename), rsize)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"Error\":\"format\"}"))
+		return
+	}
 	if res == nil {
 		http.NotFound(w, r)
 		return
 	}
-	w.Header().Set("Content-Type", res.mime)
-	w.Header().Set("x-height", strconv.Itoa(res.H))
-	w.Header().Set("x-width", strconv.Itoa(res.W))
+	setMetaHeaders(w, res)
 	http.ServeFile(w, r, *filepath)
 	L().Info("Endpoint Hit: Texture served: %s %d", filename, (makeTimestamp() - tm1))
 }
 
+// getMip serves a level of the power-of-two mip chain of an image. In pad mode
+// x-content-width and x-content-height give the part covered by the image.
+func (x *RequestsHandler) getMip(w http.ResponseWriter, r *http.Request) {
+	tm1 := makeTimestamp()
+	filename := chi.URLParam(r, "file")
+	level, err := parseMipLevel(chi.URLParam(r, "level"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	mode := x.MipMode
+	if m := r.URL.Query().Get("mode"); m != "" {
+		if !isMipMode(m) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"mode\"}"))
+			return
+		}
+		mode = m
+	}
+
+	L().Debug("Endpoint Hit: Mip Get:", filename, mode, level)
+
+	res, filepath, content := x.presentMip(&(filename), mode, level)
+	if res == nil {
+		http.NotFound(w, r)
+		return
+	}
+	setMetaHeaders(w, res)
+	w.Header().Set("x-content-width", strconv.Itoa(content.X))
+	w.Header().Set("x-content-height", strconv.Itoa(content.Y))
+	http.ServeFile(w, r, *filepath)
+	L().Info("Endpoint Hit: Mip served: %s %d", filename, (makeTimestamp() - tm1))
+}
+
 func (x *RequestsHandler) addFrame(w http.ResponseWriter, r *http.Request) {
 	L().Debug("Endpoint Hit: Add Frame")
 
@@ -317,6 +738,14 @@ func (x *RequestsHandler) addFrame(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if field := invalidFrameField(&payload); field != "" {
+		msg := "{\"Error\":\"" + field + "\"}"
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(msg))
+		L().Error(msg)
+		return
+	}
+
 	ID := GetMD5HashByte(body)
 
 	if IDi != "" && IDi != ID {
@@ -346,7 +775,7 @@ func (x *RequestsHandler) addFrame(w http.ResponseWriter, r *http.Request) {
 	// }()
 	// time.Sleep(time.Millisecond * 10)
 	L().Debug("responding with hash")
-	w.Write([]byte("{\"hash\":\"" + ID + "\"}"))
+	x.writeHashResponse(w, ID)
 
 }
 
@@ -362,17 +791,181 @@ func (x *RequestsHandler) addImage(w http.ResponseWriter, r *http.Request) {
 		L().Error(fmt.Errorf("error during reading body: %v", err))
 		return
 	}
-	err, hash := x.ProcessImage(body0)
+	quality := 0
+	if q := r.URL.Query().Get("quality"); q != "" {
+		quality, err = strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 100 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"quality\"}"))
+			L().Error("{\"Error\":\"quality\"}")
+			return
+		}
+	}
+	filter := r.URL.Query().Get("filter")
+	if filter != "" && !isFilter(filter) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"Error\":\"filter\"}"))
+		L().Error("{\"Error\":\"filter\"}")
+		return
+	}
+	err, hash := x.ProcessImage(body0, quality, filter)
 	if err != nil {
 		sentry.CaptureException(err)
 		L().Error(fmt.Errorf("error during writing image: %v", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.Write([]byte("{\"hash\":\"" + hash + "\"}"))
+	x.writeHashResponse(w, hash)
 	return
 }
 
+func (x *RequestsHandler) addAtlas(w http.ResponseWriter, r *http.Request) {
+	L().Debug("Endpoint Hit: Add Atlas")
+
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"Error\":\"body\"}"))
+		sentry.CaptureException(err)
+		L().Error("{\"Error\":\"body\"}")
+		return
+	}
+
+	var payload AtlasRequest
+	if err = json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("{\"Error\":\"json\"}"))
+		L().Error("{\"Error\":\"json\"}")
+		return
+	}
+	if len(payload.Images) == 0 || len(payload.Images) > maxAtlasImages {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"Error\":\"images\"}"))
+		return
+	}
+	if payload.MaxSize < 0 || payload.MaxSize > maxAtlasSize {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"Error\":\"max_size\"}"))
+		return
+	}
+	if payload.Padding != nil && (*payload.Padding < 0 || *payload.Padding > maxAtlasPadding) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"Error\":\"padding\"}"))
+		return
+	}
+	for _, ID := range payload.Images {
+		if !assetIDRe.MatchString(ID) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"images\"}"))
+			return
+		}
+		if res, _ := x.present(&ID); res == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("{\"Error\":\"not found\",\"hash\":\"" + ID + "\"}"))
+			return
+		}
+	}
+
+	res, err := x.BuildAtlas(&payload)
+	if err == errAtlasSize {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("{\"Error\":\"max_size\"}"))
+		return
+	}
+	if err != nil {
+		sentry.CaptureException(err)
+		L().Error(fmt.Errorf("error during atlas packing: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(res)
+	if check_error(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+func (x *RequestsHandler) addCubemap(w http.ResponseWriter, r *http.Request) {
+	filename := chi.URLParam(r, "file")
+	L().Debug("Endpoint Hit: Add Cubemap:", filename)
+
+	size := 0
+	if s := r.URL.Query().Get("size"); s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil || size < 1 || size > maxCubemapFace {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"size\"}"))
+			return
+		}
+	}
+
+	if res, _ := x.present(&filename); res == nil {
+		http.NotFound(w, r)
+		return
+	}
+	res, err := x.BuildCubemap(filename, size)
+	if err == errCubemapAspect {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("{\"Error\":\"aspect\"}"))
+		return
+	}
+	if err != nil {
+		sentry.CaptureException(err)
+		L().Error(fmt.Errorf("error during cubemap conversion: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(res)
+	if check_error(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (x *RequestsHandler) addNormalMap(w http.ResponseWriter, r *http.Request) {
+	filename := chi.URLParam(r, "file")
+	L().Debug("Endpoint Hit: Add Normal Map:", filename)
+
+	strength := defaultNormalStrength
+	if s := r.URL.Query().Get("strength"); s != "" {
+		var err error
+		strength, err = strconv.ParseFloat(s, 64)
+		if err != nil || !(strength > 0 && strength <= maxNormalStrength) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"strength\"}"))
+			return
+		}
+	}
+	invert := false
+	if s := r.URL.Query().Get("invert"); s != "" {
+		var err error
+		if invert, err = strconv.ParseBool(s); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"Error\":\"invert\"}"))
+			return
+		}
+	}
+
+	if res, _ := x.present(&filename); res == nil {
+		http.NotFound(w, r)
+		return
+	}
+	hash, err := x.BuildNormalMap(filename, strength, invert)
+	if err != nil {
+		sentry.CaptureException(err)
+		L().Error(fmt.Errorf("error during normal map generation: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	x.writeHashResponse(w, hash)
+}
+
 func (x *RequestsHandler) renderTube(w http.ResponseWriter, r *http.Request) {
 	L().Info("Endpoint Hit: Add Tube")
 	body, err := ioutil.ReadAll(r.Body)
@@ -390,7 +983,7 @@ func (x *RequestsHandler) renderTube(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.Write([]byte("{\"hash\":\"" + hash + "\"}"))
+	x.writeHashResponse(w, hash)
 	return
 }
 
@@ -437,10 +1030,18 @@ func handle_http(cfg *LocalConfig) {
 	myRouter.MethodFunc("POST", "/render/addimage", myRequestsHandler.addImage)
 	myRouter.MethodFunc("POST", "/render/addframe", myRequestsHandler.addFrame)
 	myRouter.MethodFunc("POST", "/render/addtube", myRequestsHandler.renderTube)
+	myRouter.MethodFunc("POST", "/render/atlas", myRequestsHandler.addAtlas)
+	myRouter.MethodFunc("POST", "/render/cubemap/{file:[a-zA-Z0-9]+}", myRequestsHandler.addCubemap)
+	myRouter.MethodFunc("POST", "/render/normalmap/{file:[a-zA-Z0-9]+}", myRequestsHandler.addNormalMap)
 	myRouter.MethodFunc("POST", "/addtrack", myRequestsHandler.addTrack)
 	myRouter.MethodFunc("DELETE", "/deltrack/{file:[a-zA-Z0-9]+}", myRequestsHandler.delTrack)
 	myRouter.MethodFunc("GET", API_PREFIX+"/render/get/{file:[a-zA-Z0-9]+}", myRequestsHandler.getImage)
-	myRouter.MethodFunc("GET", API_PREFIX+"/render/texture/{rsize:s[0-9]}/{file:[a-zA-Z0-9]+}", myRequestsHandler.getTexture)
+	myRouter.MethodFunc("GET", API_PREFIX+"/render/texture/{rsize:[a-zA-Z0-9_-]+}/{file:[a-zA-Z0-9]+}", myRequestsHandler.getTexture)
+	myRouter.MethodFunc("GET", API_PREFIX+"/render/mip/{level:[0-9]+}/{file:[a-zA-Z0-9]+}", myRequestsHandler.getMip)
+	myRouter.MethodFunc("GET", API_PREFIX+"/render/poster/{file:[a-zA-Z0-9]+}", myRequestsHandler.getPoster)
+	myRouter.MethodFunc("GET", API_PREFIX+"/render/poster/{rsize:[a-zA-Z0-9_-]+}/{file:[a-zA-Z0-9]+}", myRequestsHandler.getPoster)
+	myRouter.MethodFunc("GET", API_PREFIX+"/render/palette/{file:[a-zA-Z0-9]+}", myRequestsHandler.getPalette)
+	myRouter.MethodFunc("GET", API_PREFIX+"/render/similar/{file:[a-zA-Z0-9]+}", myRequestsHandler.getSimilar)
 	myRouter.MethodFunc("GET", API_PREFIX+"/render/track/{file:[a-zA-Z0-9]+}", myRequestsHandler.getTrack)
 
 	if err := http.ListenAndServe(cfg.Address+":"+strconv.FormatUint(uint64(cfg.Port), 10), myRouter); err != nil {
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+// newTestHandler returns a handler storing its files in a temporary
+// directory, with the default texture sizes.
+func newTestHandler(t *testing.T) *RequestsHandler {
+	t.Helper()
+	dir := t.TempDir()
+	return DefRequestsHandler(&LocalConfig{
+		Imagepath:       dir + "/images",
+		Audiopath:       dir + "/images/tracks",
+		Fontpath:        "fonts",
+		TextureQuality:  defaultTextureQuality,
+		MipMode:         mipResize,
+		TextureSizes:    defaultTextureBuckets(),
+		TexturePrecalcs: defaultTexturePrecalcs(),
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+	"math/bits"
+	"os"
+	"strconv"
+
+	"github.com/disintegration/gift"
+)
+
+// Mip modes: resize stretches the image to the nearest power-of-two size,
+// pad keeps its aspect ratio and fills the rest of the next power-of-two size
+// with transparency, leaving the content in the top left corner.
+const (
+	mipResize = "resize"
+	mipPad    = "pad"
+)
+
+var mipModes = [...]string{mipResize, mipPad}
+
+const (
+	maxMipEdge  = 4096
+	maxMipLevel = 12 // log2(maxMipEdge)
+)
+
+func isMipMode(mode string) bool {
+	return mode == mipResize || mode == mipPad
+}
+
+// potNearest returns the power of two closest to v on a logarithmic scale.
+func potNearest(v int) int {
+	if v <= 1 {
+		return 1
+	}
+	lo := 1 << (bits.Len(uint(v)) - 1)
+	if lo == v {
+		return v
+	}
+	if float64(v)/float64(lo) < math.Sqrt2 {
+		return lo
+	}
+	return lo << 1
+}
+
+// potCeil returns the smallest power of two not below v.
+func potCeil(v int) int {
+	if v <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(v-1))
+}
+
+// mipBase returns the size of level 0 of the mip chain of a w x h image and
+// the size of the image content in it, which only differs in pad mode.
+func mipBase(w, h int, mode string) (pw, ph, cw, ch int) {
+	if mode == mipPad {
+		scl := math.Min(1, float64(maxMipEdge)/float64(maxInt(w, h)))
+		cw = maxInt(1, int(math.Round(float64(w)*scl)))
+		ch = maxInt(1, int(math.Round(float64(h)*scl)))
+		return potCeil(cw), potCeil(ch), cw, ch
+	}
+	pw = minInt(potNearest(w), maxMipEdge)
+	ph = minInt(potNearest(h), maxMipEdge)
+	return pw, ph, pw, ph
+}
+
+// mipLevels returns the length of the mip chain down to 1x1.
+func mipLevels(pw, ph int) int {
+	return bits.Len(uint(maxInt(pw, ph)))
+}
+
+// mipLevelSize returns the size of v at the given mip level, rounding up so
+// partially covered pixels of padded content are counted.
+func mipLevelSize(v, level int) int {
+	return maxInt(1, (v+(1<<level)-1)>>level)
+}
+
+// halveRGBA computes the next mip level by averaging 2x2 blocks in linear
+// light on premultiplied alpha, like the textures are scaled. Edges of size 1
+// are kept.
+func halveRGBA(src *image.RGBA) *image.RGBA {
+	sb := src.Bounds()
+	half := resampleLinear(src, maxInt(1, sb.Dx()/2), maxInt(1, sb.Dy()/2), gift.BoxResampling)
+	dst := image.NewRGBA(half.Bounds())
+	draw.Draw(dst, dst.Bounds(), half, image.Point{}, draw.Src)
+	return dst
+}
+
+func (x *RequestsHandler) mipPath(mode string, level int) string {
+	return x.ImPathMip[mode] + strconv.Itoa(level) + "/"
+}
+
+// mipBaseImage renders level 0 of the mip chain, scaled in linear light like
+// the other levels. SVG sources are rasterized directly at the content size.
+func (x *RequestsHandler) mipBaseImage(ID string, meta *MetaDef, mode string) (*image.RGBA, error) {
+	pw, ph, cw, ch := mipBase(meta.W, meta.H, mode)
+	var content image.Image
+	if svg, ok := x.svgSource(ID); ok {
+		img, err := rasterizeSVG(svg, cw, ch)
+		if err != nil {
+			return nil, err
+		}
+		content = img
+	} else {
+		img, err := x.LoadFull(ID)
+		if err != nil {
+			return nil, err
+		}
+		if x.isNormalMap(ID) {
+			content = resampleNormals(img, cw, ch, x.mipFilter(ID))
+		} else {
+			content = resampleLinear(img, cw, ch, x.mipFilter(ID))
+		}
+	}
+	base := image.NewRGBA(image.Rect(0, 0, pw, ph))
+	draw.Draw(base, content.Bounds().Sub(content.Bounds().Min), content, content.Bounds().Min, draw.Src)
+	return base, nil
+}
+
+// WriteMipChain stores all levels of the mip chain of an image, all of them in
+// the format chosen for level 0. Animations use their first frame, normal maps
+// are stored as PNG and renormalized on every level.
+func (x *RequestsHandler) WriteMipChain(ID string, meta *MetaDef, mode string) error {
+	img, err := x.mipBaseImage(ID, meta, mode)
+	if err != nil {
+		return err
+	}
+	normal := x.isNormalMap(ID)
+	photo := !normal && isOpaque(img) && isPhotographic(img)
+	for level := 0; ; level++ {
+		fname := x.mipPath(mode, level) + ID
+		if photo {
+			err = x.SaveWriteToJPEG(fname, img, x.textureQuality(ID))
+		} else {
+			err = x.SaveWriteToPNG(fname, img)
+		}
+		if err != nil {
+			return err
+		}
+		if img.Bounds().Dx() == 1 && img.Bounds().Dy() == 1 {
+			return nil
+		}
+		if normal {
+			img = halveNormals(img)
+		} else {
+			img = halveRGBA(img)
+		}
+	}
+}
+
+// presentMip returns a level of the mip chain of an image, creating the chain
+// on first use. The returned content size is the part of the texture covered
+// by the image.
+func (x *RequestsHandler) presentMip(ID *string, mode string, level int) (*MetaDef, *string, image.Point) {
+	full, _ := x.present(ID)
+	if full == nil || full.W == 0 || full.H == 0 {
+		return nil, nil, image.Point{}
+	}
+	pw, ph, cw, ch := mipBase(full.W, full.H, mode)
+	if level >= mipLevels(pw, ph) {
+		return nil, nil, image.Point{}
+	}
+	content := image.Pt(mipLevelSize(cw, level), mipLevelSize(ch, level))
+
+	key := mode + "/" + strconv.Itoa(level) + "/" + *ID
+	fpath := x.mipPath(mode, level) + *ID
+	if meta0, ok := x.ImageMapMip.Get(key); ok {
+		L().Debug(key + " is already in the map")
+		return meta0.(*MetaDef), &fpath, content
+	}
+
+	reader, err := os.Open(fpath)
+	if err != nil {
+		L().Debug(*ID + " : creating mip chain")
+		if check_error(x.WriteMipChain(*ID, full, mode)) {
+			return nil, nil, image.Point{}
+		}
+		if reader, err = os.Open(fpath); check_error(err) {
+			return nil, nil, image.Point{}
+		}
+	}
+
+	defer reader.Close()
+	meta := x.decodeMeta(reader, *ID)
+	x.ImageMapMip.Add(key, meta)
+	return meta, &fpath, content
+}
+
+func parseMipLevel(s string) (int, error) {
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 0 || level > maxMipLevel {
+		return 0, errors.New("invalid mip level")
+	}
+	return level, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
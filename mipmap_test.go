@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// TestMipBaseLinear checks that level 0 is scaled in linear light: fine black
+// and white stripes keep half the light.
+func TestMipBaseLinear(t *testing.T) {
+	x := newTestHandler(t)
+	src := image.NewGray(image.Rect(0, 0, 22, 22))
+	for y := 0; y < 22; y++ {
+		for x := 0; x < 22; x += 2 {
+			src.SetGray(x, y, color.Gray{255})
+		}
+	}
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, src); err != nil {
+		t.Fatal(err)
+	}
+	err, ID := x.ProcessImage(enc.Bytes(), 0, "box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fpath, _ := x.presentMip(&ID, mipResize, 0)
+	if fpath == nil {
+		t.Fatal("no mip level 0")
+	}
+	f, err := os.Open(*fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := img.Bounds()
+	if b.Dx() != 16 || b.Dy() != 16 {
+		t.Fatalf("level 0 is %v", b.Size())
+	}
+	var sum float32
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, _, _, _ := img.At(x, y).RGBA()
+			sum += srgbDecode[r>>8]
+		}
+	}
+	if mean := sum / (16 * 16); mean < 0.45 || mean > 0.55 {
+		t.Errorf("mean level 0 light %.3f, want 0.5", mean)
+	}
+}
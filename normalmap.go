@@ -0,0 +1,174 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+
+	"github.com/disintegration/gift"
+)
+
+const (
+	defaultNormalStrength = 2.0
+	maxNormalStrength     = 32.0
+)
+
+// heightField returns the luminance of an image in [0, 1], transparent areas
+// being the lowest.
+func heightField(img image.Image) ([]float64, int, int) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	hf := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA64)
+			l := 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+			hf[y*w+x] = l * float64(c.A) / (0xffff * 0xffff)
+		}
+	}
+	return hf, w, h
+}
+
+// NormalMap derives a tangent-space normal map (OpenGL convention, green up)
+// from the luminance of an image with a Sobel filter. strength scales the
+// slopes, invert treats dark areas as raised.
+func NormalMap(img image.Image, strength float64, invert bool) *image.NRGBA {
+	hf, w, h := heightField(img)
+	if invert {
+		for i := range hf {
+			hf[i] = 1 - hf[i]
+		}
+	}
+	at := func(x, y int) float64 {
+		return hf[(minInt(maxInt(y, 0), h-1))*w+minInt(maxInt(x, 0), w-1)]
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			tl, t, tr := at(x-1, y-1), at(x, y-1), at(x+1, y-1)
+			l, r := at(x-1, y), at(x+1, y)
+			bl, bt, br := at(x-1, y+1), at(x, y+1), at(x+1, y+1)
+			dx := (tr + 2*r + br) - (tl + 2*l + bl)
+			dy := (bl + 2*bt + br) - (tl + 2*t + tr)
+			// image rows grow downwards, tangent space y points up
+			nx, ny, nz := -dx*strength, dy*strength, 1.0
+			n := math.Sqrt(nx*nx + ny*ny + nz*nz)
+			out.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(math.Round((nx/n*0.5 + 0.5) * 255)),
+				G: uint8(math.Round((ny/n*0.5 + 0.5) * 255)),
+				B: uint8(math.Round((nz/n*0.5 + 0.5) * 255)),
+				A: 255,
+			})
+		}
+	}
+	return out
+}
+
+// decodeNormal converts a stored normal to a vector weighted by its alpha, so
+// transparent pixels don't tilt their neighbours.
+func decodeNormal(p []uint8, c []float32) {
+	a := float32(p[3]) / 255
+	c[0] = (float32(p[0])/255*2 - 1) * a
+	c[1] = (float32(p[1])/255*2 - 1) * a
+	c[2] = (float32(p[2])/255*2 - 1) * a
+	c[3] = a
+}
+
+// encodeNormal stores a filtered vector renormalized to unit length. Vectors
+// cancelling out become flat.
+func encodeNormal(c []float32, d []uint8) {
+	nx, ny, nz := float64(c[0]), float64(c[1]), float64(c[2])
+	n := math.Sqrt(nx*nx + ny*ny + nz*nz)
+	if n == 0 {
+		nx, nz, n = 0, 1, 1
+	}
+	d[0] = uint8(math.Round((nx/n*0.5 + 0.5) * 255))
+	d[1] = uint8(math.Round((ny/n*0.5 + 0.5) * 255))
+	d[2] = uint8(math.Round((nz/n*0.5 + 0.5) * 255))
+	d[3] = uint8(clampUnit(c[3])*255 + 0.5)
+}
+
+// resampleNormals resizes a normal map. The stored values are filtered as
+// they are, without gamma conversion, and renormalized afterwards.
+func resampleNormals(img image.Image, w, h int, filter gift.Resampling) *image.NRGBA {
+	return resampleWith(img, w, h, filter, decodeNormal, encodeNormal)
+}
+
+// DownSampleNormals scales a normal map down to the size of a texture
+// bucket. Normal maps smaller than the bucket are kept.
+func DownSampleNormals(img image.Image, b *TextureBucket, filter gift.Resampling) image.Image {
+	nx, ny := b.ScaledSize(img.Bounds().Dx(), img.Bounds().Dy())
+	if img.Bounds().Dx() <= nx && img.Bounds().Dy() <= ny {
+		return img
+	}
+	size := gift.New(gift.ResizeToFit(nx, ny, filter)).Bounds(img.Bounds()).Size()
+	return resampleNormals(img, size.X, size.Y, filter)
+}
+
+// halveNormals computes the next mip level of a normal map, see halveRGBA.
+func halveNormals(src *image.RGBA) *image.RGBA {
+	sb := src.Bounds()
+	half := resampleNormals(src, maxInt(1, sb.Dx()/2), maxInt(1, sb.Dy()/2), gift.BoxResampling)
+	dst := image.NewRGBA(half.Bounds())
+	draw.Draw(dst, dst.Bounds(), half, image.Point{}, draw.Src)
+	return dst
+}
+
+// isNormalMap reports whether an image is a generated normal map, whose
+// textures hold vectors rather than colors.
+func (x *RequestsHandler) isNormalMap(ID string) bool {
+	am, err := x.LoadAssetMeta(ID)
+	return !check_error(err) && am.NormalMap
+}
+
+// BuildNormalMap stores the normal map of a stored image as a new image and
+// links both in their asset metadata. Normal maps already generated with the
+// same parameters are reused.
+func (x *RequestsHandler) BuildNormalMap(ID string, strength float64, invert bool) (string, error) {
+	key := strconv.FormatFloat(strength, 'g', -1, 64)
+	if invert {
+		key += "i"
+	}
+	am, err := x.LoadAssetMeta(ID)
+	if err != nil {
+		return "", err
+	}
+	if hash, ok := am.NormalMaps[key]; ok && fileExists(x.ImPathF+hash) {
+		return hash, nil
+	}
+
+	img, err := x.LoadFull(ID)
+	if err != nil {
+		return "", err
+	}
+	nm := NormalMap(img, strength, invert)
+	err, hash := x.WriteToF(nm)
+	if err != nil {
+		return "", err
+	}
+	if _, err = x.WriteImageMeta(hash, nm); err != nil {
+		return "", err
+	}
+	if _, err = x.UpdateAssetMeta(hash, func(m *AssetMeta) {
+		m.Sources = []string{ID}
+		m.NormalMap = true
+	}); err != nil {
+		return "", err
+	}
+	for _, v := range x.Tprecalcs {
+		if err = x.WriteToScaled(hash, nm, v); err != nil {
+			return "", err
+		}
+	}
+	_, err = x.UpdateAssetMeta(ID, func(m *AssetMeta) {
+		if m.NormalMaps == nil {
+			m.NormalMaps = make(map[string]string)
+		}
+		m.NormalMaps[key] = hash
+		m.addDerived(hash)
+	})
+	L().Info("Normal map:", hash)
+	return hash, err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// noiseTestImage is an opaque image of random gray values, photographic
+// enough to be stored as JPEG if it were a color texture.
+func noiseTestImage(w, h int) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(rnd.Intn(256))
+			img.SetNRGBA(x, y, color.NRGBA{v, uint8(rnd.Intn(256)), v, 255})
+		}
+	}
+	return img
+}
+
+// checkNormals fails unless a file is a PNG whose pixels are unit vectors.
+func checkNormals(t *testing.T, fpath string) image.Image {
+	t.Helper()
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s: %v", fpath, err)
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			nx, ny, nz := float64(c.R)/255*2-1, float64(c.G)/255*2-1, float64(c.B)/255*2-1
+			if n := math.Sqrt(nx*nx + ny*ny + nz*nz); math.Abs(n-1) > 0.02 {
+				t.Fatalf("%s: pixel %d,%d has length %.3f", fpath, x, y, n)
+			}
+		}
+	}
+	return img
+}
+
+func TestNormalMapTextures(t *testing.T) {
+	x := newTestHandler(t)
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, noiseTestImage(600, 400)); err != nil {
+		t.Fatal(err)
+	}
+	err, ID := x.ProcessImage(enc.Bytes(), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := x.BuildNormalMap(ID, 8, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rs := range x.Tprecalcs {
+		checkNormals(t, x.ImPathS[rs]+hash)
+	}
+
+	_, fpath, _ := x.presentMip(&hash, mipResize, 1)
+	if fpath == nil {
+		t.Fatal("no mip level 1")
+	}
+	checkNormals(t, *fpath)
+
+	rs := x.Tprecalcs[0]
+	if err = x.WriteKTX2Scaled(hash, rs); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(x.ImPathKTX2[rs] + hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format := binary.LittleEndian.Uint32(data[12:]); format != vkFormatR8G8B8A8UNORM {
+		t.Errorf("KTX2 format %d, want %d", format, vkFormatR8G8B8A8UNORM)
+	}
+	dfd := binary.LittleEndian.Uint32(data[48:])
+	if transfer := data[dfd+14]; transfer != dfdTransferLinear {
+		t.Errorf("KTX2 transfer %d, want %d", transfer, dfdTransferLinear)
+	}
+}
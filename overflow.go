@@ -0,0 +1,46 @@
+package main
+
+import "image"
+
+const (
+	overflowVisible = "visible"
+	overflowHidden  = "hidden"
+)
+
+func isOverflow(mode string) bool {
+	return mode == overflowVisible || mode == overflowHidden
+}
+
+// clipsSubframes reports whether a frame clips its subframes to the area
+// inside its border. As in CSS, only hidden overflow clips.
+func clipsSubframes(frame *FrameDesc) bool {
+	return frame.Overflow == overflowHidden
+}
+
+// contentRect returns the area of a frame and the subframes it doesn't clip,
+// relative to the frame.
+func contentRect(frame *FrameDesc) image.Rectangle {
+	r := image.Rect(0, 0, frame.Width, frame.Height)
+	if clipsSubframes(frame) {
+		return r
+	}
+	for _, sf := range frame.Sub {
+		if sf != nil {
+			r = r.Union(frameExtent(sf).Add(image.Pt(sf.X, sf.Y)))
+		}
+	}
+	return r
+}
+
+// frameExtent returns the area a frame may draw to, including its shadow,
+// blur and transform, relative to its position.
+func frameExtent(frame *FrameDesc) image.Rectangle {
+	r := contentRect(frame)
+	if needsLayer(frame) {
+		r = r.Inset(-layerMargin(frame))
+		if hasTransform(frame) {
+			r = transformedRect(r, frameMatrix(frame, 0, 0))
+		}
+	}
+	return r
+}
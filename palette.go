@@ -0,0 +1,152 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+	"strconv"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	defaultPaletteSize = 5
+	maxPaletteSize     = 32
+	paletteSampleMax   = 128
+)
+
+type colorBox struct {
+	pixels []color.NRGBA
+}
+
+// channelRange returns the channel (0=r, 1=g, 2=b) with the widest spread
+// in the box and that spread.
+func (b *colorBox) channelRange() (int, int) {
+	lo := [3]uint8{255, 255, 255}
+	hi := [3]uint8{}
+	for _, p := range b.pixels {
+		for i, v := range [3]uint8{p.R, p.G, p.B} {
+			if v < lo[i] {
+				lo[i] = v
+			}
+			if v > hi[i] {
+				hi[i] = v
+			}
+		}
+	}
+	ch, rng := 0, -1
+	for i := 0; i < 3; i++ {
+		if int(hi[i])-int(lo[i]) > rng {
+			ch, rng = i, int(hi[i])-int(lo[i])
+		}
+	}
+	return ch, rng
+}
+
+func (b *colorBox) average() []uint32 {
+	var r, g, bl int
+	for _, p := range b.pixels {
+		r += int(p.R)
+		g += int(p.G)
+		bl += int(p.B)
+	}
+	n := len(b.pixels)
+	return []uint32{uint32((r + n/2) / n), uint32((g + n/2) / n), uint32((bl + n/2) / n), 255}
+}
+
+func channel(p color.NRGBA, ch int) uint8 {
+	switch ch {
+	case 0:
+		return p.R
+	case 1:
+		return p.G
+	}
+	return p.B
+}
+
+// ExtractPalette returns up to count colors of the image using median cut,
+// most frequent first, in FrameDesc color form. Mostly transparent pixels are
+// ignored.
+func ExtractPalette(img image.Image, count int) [][]uint32 {
+	b := img.Bounds()
+	if b.Dx() > paletteSampleMax || b.Dy() > paletteSampleMax {
+		if b.Dx() > b.Dy() {
+			img = resize.Resize(paletteSampleMax, 0, img, resize.Bilinear)
+		} else {
+			img = resize.Resize(0, paletteSampleMax, img, resize.Bilinear)
+		}
+		b = img.Bounds()
+	}
+
+	var pixels []color.NRGBA
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A >= 0x80 {
+				pixels = append(pixels, c)
+			}
+		}
+	}
+	if len(pixels) == 0 {
+		return [][]uint32{}
+	}
+
+	boxes := []*colorBox{{pixels: pixels}}
+	for len(boxes) < count {
+		split, splitCh, splitRng := -1, 0, 0
+		for i, bx := range boxes {
+			if len(bx.pixels) < 2 {
+				continue
+			}
+			ch, rng := bx.channelRange()
+			if rng > splitRng {
+				split, splitCh, splitRng = i, ch, rng
+			}
+		}
+		if split < 0 {
+			break
+		}
+		bx := boxes[split]
+		sort.SliceStable(bx.pixels, func(i, j int) bool {
+			return channel(bx.pixels[i], splitCh) < channel(bx.pixels[j], splitCh)
+		})
+		mid := len(bx.pixels) / 2
+		boxes[split] = &colorBox{pixels: bx.pixels[:mid]}
+		boxes = append(boxes, &colorBox{pixels: bx.pixels[mid:]})
+	}
+
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return len(boxes[i].pixels) > len(boxes[j].pixels)
+	})
+	colors := make([][]uint32, 0, len(boxes))
+	for _, bx := range boxes {
+		colors = append(colors, bx.average())
+	}
+	return colors
+}
+
+// Palette returns the palette of a stored image, computing it from the full
+// image on first use and caching it in the asset metadata.
+func (x *RequestsHandler) Palette(ID string, count int) ([][]uint32, error) {
+	key := strconv.Itoa(count)
+	am, err := x.LoadAssetMeta(ID)
+	if err != nil {
+		return nil, err
+	}
+	if colors, ok := am.Palettes[key]; ok {
+		return colors, nil
+	}
+
+	img, err := x.LoadFull(ID)
+	if err != nil {
+		return nil, err
+	}
+	colors := ExtractPalette(img, count)
+	_, err = x.UpdateAssetMeta(ID, func(m *AssetMeta) {
+		if m.Palettes == nil {
+			m.Palettes = make(map[string][][]uint32)
+		}
+		m.Palettes[key] = colors
+	})
+	return colors, err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	blurhashChars     = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+	blurhashSampleMax = 32
+	blurhashMaxComps  = 4
+)
+
+// placeholderSample returns a small opaque copy of the image, composed over
+// white so transparent areas don't turn the placeholder dark.
+func placeholderSample(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	w, h := uint(blurhashSampleMax), uint(blurhashSampleMax)
+	if b.Dx() > b.Dy() {
+		h = 0
+	} else {
+		w = 0
+	}
+	small := resize.Resize(w, h, img, resize.Bilinear)
+	out := image.NewRGBA(small.Bounds())
+	draw.Draw(out, out.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(out, out.Bounds(), small, small.Bounds().Min, draw.Over)
+	return out
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	c := math.Max(0, math.Min(1, v))
+	if c <= 0.0031308 {
+		return int(c*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func encodeBase83(value, length int) string {
+	var sb strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(blurhashChars[digit])
+	}
+	return sb.String()
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// Blurhash encodes the image as a BlurHash string (https://blurha.sh). The
+// number of components follows the aspect ratio of the image.
+func Blurhash(img image.Image) string {
+	sample := placeholderSample(img)
+	b := sample.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+	cx, cy := blurhashMaxComps, blurhashMaxComps
+	if w > h {
+		cy = int(math.Max(1, math.Round(float64(blurhashMaxComps*h)/float64(w))))
+	} else if h > w {
+		cx = int(math.Max(1, math.Round(float64(blurhashMaxComps*w)/float64(h))))
+	}
+
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			var r, g, bl float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					c := sample.RGBAAt(b.Min.X+x, b.Min.Y+y)
+					r += basis * srgbToLinear(c.R)
+					g += basis * srgbToLinear(c.G)
+					bl += basis * srgbToLinear(c.B)
+				}
+			}
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{r * scale, g * scale, bl * scale})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encodeBase83((cx-1)+(cy-1)*9, 1))
+
+	maxValue := 1.0
+	ac := factors[1:]
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	sb.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encodeBase83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+	return sb.String()
+}
+
+// DominantColor returns the average color of the most populated bucket of a
+// coarse color histogram, weighted by alpha, in FrameDesc color form.
+func DominantColor(img image.Image) []uint32 {
+	b := img.Bounds()
+	w, h := uint(blurhashSampleMax*2), uint(blurhashSampleMax*2)
+	if b.Dx() > b.Dy() {
+		h = 0
+	} else {
+		w = 0
+	}
+	small := resize.Resize(w, h, img, resize.Bilinear)
+	type bucket struct {
+		r, g, b, weight float64
+	}
+	buckets := make(map[int]*bucket)
+	sb := small.Bounds()
+	for y := sb.Min.Y; y < sb.Max.Y; y++ {
+		for x := sb.Min.X; x < sb.Max.X; x++ {
+			c := color.NRGBAModel.Convert(small.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+			key := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = new(bucket)
+				buckets[key] = bk
+			}
+			a := float64(c.A) / 255
+			bk.r += float64(c.R) * a
+			bk.g += float64(c.G) * a
+			bk.b += float64(c.B) * a
+			bk.weight += a
+		}
+	}
+	var best *bucket
+	bestKey := -1
+	for k, bk := range buckets {
+		// ties resolve to the lowest key so the result is deterministic
+		if best == nil || bk.weight > best.weight || (bk.weight == best.weight && k < bestKey) {
+			best, bestKey = bk, k
+		}
+	}
+	if best == nil {
+		return []uint32{0, 0, 0, 0}
+	}
+	return []uint32{
+		uint32(math.Round(best.r / best.weight)),
+		uint32(math.Round(best.g / best.weight)),
+		uint32(math.Round(best.b / best.weight)),
+		255,
+	}
+}
+
+// WriteImageMeta computes the BlurHash, dominant color and difference hash
+// of an image, stores them in the asset metadata and indexes the hash.
+func (x *RequestsHandler) WriteImageMeta(ID string, img image.Image) (*AssetMeta, error) {
+	hash := Blurhash(img)
+	col := DominantColor(img)
+	ph := DHash(img)
+	meta, err := x.UpdateAssetMeta(ID, func(m *AssetMeta) {
+		m.Placeholder = hash
+		m.Color = col
+		m.DHash = formatDHash(ph)
+	})
+	if err == nil {
+		x.DHashes.Set(ID, ph)
+	}
+	return meta, err
+}
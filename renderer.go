@@ -8,6 +8,7 @@ import (
 	"github.com/oakmound/oak/v3/render/mod"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/png"
 	"math"
 	"os"
@@ -16,6 +17,11 @@ import (
 	"sync"
 )
 
+// FrameDesc describes a frame to render with its subframes. Colors are RGB
+// or RGBA components from 0 to 255. Background, Color and Fontcolor are
+// premultiplied alpha, as they always have been; BorderColor and the colors
+// of gradients and shadows are straight alpha. Blur and BackdropBlur are
+// standard deviations in pixels, shadow blur is a CSS radius, twice that.
 type FrameDesc struct {
 	Background []uint32     `json:"background"`
 	BGimage    string       `json:"bgimage"`
@@ -27,6 +33,54 @@ type FrameDesc struct {
 	Y          int          `json:"y"`
 	Text       *TextDesc    `json:"text"`
 	Sub        []*FrameDesc `json:"sub"`
+	// Filter is the resampling filter for the background image. On the root
+	// frame it also selects the filter of the textures of the rendered frame.
+	Filter string `json:"filter"`
+	// BGCrop selects how the background image is cropped to the aspect of
+	// the frame: "smart" keeps the most salient region, empty stretches it.
+	BGCrop string `json:"bgcrop"`
+	// BGFit is one of bgFitModes, stretch if empty. BGAnchor places the
+	// image for all modes but stretch, see bgAnchors; it is centered if
+	// empty. BGOpacity defaults to 1.
+	BGFit     string   `json:"bgfit"`
+	BGAnchor  string   `json:"bganchor"`
+	BGOpacity *float64 `json:"bgopacity"`
+	// BGSlice are the nine-slice insets of the background image in its
+	// pixels, as top, right, bottom, left or shortened like CSS
+	// border-image-slice. If set the image fills the frame with unscaled
+	// corners, ignoring BGFit, BGAnchor and BGCrop.
+	BGSlice []int `json:"bgslice"`
+	// Radius rounds the corners, one value for all of them or top-left,
+	// top-right, bottom-right and bottom-left. Background and subframes are
+	// clipped to the rounded shape.
+	Radius []float64 `json:"radius"`
+	// BorderWidth and BorderColor set the border per side as top, right,
+	// bottom, left or shortened like CSS, overriding Thickness and Color.
+	// Unlike Color, BorderColor is straight alpha.
+	// BorderStyle is one of borderStyles, solid if empty.
+	BorderWidth []int      `json:"borderwidth"`
+	BorderColor [][]uint32 `json:"bordercolor"`
+	BorderStyle string     `json:"borderstyle"`
+	// Gradient fills the frame in place of Background
+	Gradient *GradientDesc `json:"gradient"`
+	// Shadow is cast by the frame shape. Blur blurs the rendered frame with
+	// its subframes, BackdropBlur what lies below the frame, both as the
+	// standard deviation in pixels.
+	Shadow       *ShadowDesc `json:"shadow"`
+	Blur         float64     `json:"blur"`
+	BackdropBlur float64     `json:"backdropBlur"`
+	// Opacity fades the frame with its subframes, 1 if not set. Rotation in
+	// degrees clockwise and Scale, 1 if not set, turn and resize them about
+	// Origin, given as a fraction of the frame size and defaulting to the
+	// middle.
+	Opacity  *float64  `json:"opacity"`
+	Rotation float64   `json:"rotation"`
+	Scale    float64   `json:"scale"`
+	Origin   []float64 `json:"origin"`
+	// Overflow is visible or hidden. Hidden clips the subframes to the area
+	// inside the border and its rounded shape, visible lets them draw over
+	// it. Empty is visible.
+	Overflow string `json:"overflow"`
 }
 
 type TextDesc struct {
@@ -40,6 +94,11 @@ type TextDesc struct {
 	AlignH    string   `json:"alignH"`
 	AlignV    string   `json:"alignV"`
 	DPI       float64  `json:"dpi"`
+	// Gradient fills the glyphs in place of Fontcolor. It spans the frame,
+	// not just the text.
+	Gradient *GradientDesc `json:"gradient"`
+	// Shadow is cast by the glyphs
+	Shadow *ShadowDesc `json:"shadow"`
 }
 
 const (
@@ -60,6 +119,8 @@ func needrender(ID *string) bool {
 	return true
 }
 
+// getColor returns the color of Background, Color and Fontcolor. Four
+// components are taken as premultiplied alpha, as they always have been.
 func getColor(components []uint32) color.Color {
 	if components == nil {
 		L().Warn("No color")
@@ -78,6 +139,15 @@ func getColor(components []uint32) color.Color {
 	return color.RGBA{R: uint8(components[0]), G: uint8(components[1]), B: uint8(components[2]), A: 255}
 }
 
+// getStraightColor returns the color of the fields added along with
+// translucent rendering, whose four components are straight alpha.
+func getStraightColor(components []uint32) color.Color {
+	if len(components) == 4 {
+		return color.NRGBA{R: uint8(components[0]), G: uint8(components[1]), B: uint8(components[2]), A: uint8(components[3])}
+	}
+	return getColor(components)
+}
+
 func (x *RequestsHandler) RenderFrame(req *FrameRenderRequest) {
 	if req.Frame == nil {
 		return
@@ -105,7 +175,14 @@ func (x *RequestsHandler) RenderFrame(req *FrameRenderRequest) {
 
 	if reader, err := os.Open(fname); !check_error(err) {
 		if img, _, err := image.Decode(reader); !check_error(err) {
-			for _, v := range Tprecalcs {
+			_, err = x.WriteImageMeta(*req.ID, img)
+			check_error(err)
+			filter := req.Frame.Filter
+			if filter == "" && hasText(req.Frame) {
+				filter = defaultFrameFilter
+			}
+			check_error(x.SetTextureFilter(*req.ID, filter))
+			for _, v := range x.Tprecalcs {
 				x.WriteToScaled(*req.ID, img, v)
 			}
 		}
@@ -121,24 +198,23 @@ func (x *RequestsHandler) renderSubFrame(frame *FrameDesc, xul int, yul int, img
 		return
 	}
 	L().Debug(frame)
-	img.AppendOffset(
-		render.NewColorBoxM(frame.Width, frame.Height, getColor(frame.Background)),
-		floatgeom.Point2{float64(xul), float64(yul)},
-	)
+	if needsLayer(frame) {
+		x.renderLayered(frame, xul, yul, img)
+		return
+	}
+	img.AppendOffset(backgroundSprite(frame), floatgeom.Point2{float64(xul), float64(yul)})
 	if frame.BGimage != "" {
-		bgimpath := x.ImPathF + frame.BGimage
-		L().Debug("bgimage path:", bgimpath)
-		if fileExists(bgimpath) {
-			L().Debug("bgimage exists")
-			img1, err := render.LoadSprite(bgimpath)
-			check_error(err)
+		if bg := x.bgImage(frame); bg != nil {
 			L().Debug("sprite loaded")
-			img1.Modify(mod.Resize(frame.Width, frame.Height, gift.NearestNeighborResampling))
-			img.AppendOffset(img1, floatgeom.Point2{float64(xul), float64(yul)})
+			img.AppendOffset(bg, floatgeom.Point2{float64(xul), float64(yul)})
 		}
 	}
 	L().Debug("subframe5:", "xul:", xul, "yul:", yul)
-	if frame.Thickness > 0 {
+	if !legacyBorder(frame) {
+		if border := newFrameShape(frame).borderImage(); border != nil {
+			img.AppendOffset(render.NewSprite(0, 0, border), floatgeom.Point2{float64(xul), float64(yul)})
+		}
+	} else if frame.Thickness > 0 {
 		thc := float64(frame.Thickness) / 2
 		col := getColor(frame.Color)
 		fw := float64(frame.Width)
@@ -174,6 +250,192 @@ func (x *RequestsHandler) renderSubFrame(frame *FrameDesc, xul int, yul int, img
 	}
 }
 
+// backgroundSprite returns the solid or gradient fill of a frame.
+func backgroundSprite(frame *FrameDesc) *render.Sprite {
+	if frame.Gradient != nil && frame.Width > 0 && frame.Height > 0 {
+		return render.NewSprite(0, 0, GradientImage(frame.Gradient, frame.Width, frame.Height))
+	}
+	return render.NewColorBoxM(frame.Width, frame.Height, getColor(frame.Background))
+}
+
+// needsLayer reports whether a frame has to be rendered on its own canvas
+// before it is composited into its parent.
+func needsLayer(frame *FrameDesc) bool {
+	return frame.Width > 0 && frame.Height > 0 &&
+		(hasRadius(frame) || frame.Shadow != nil || frame.Blur > 0 || frame.BackdropBlur > 0 ||
+			hasTransform(frame) || frame.Overflow == overflowHidden)
+}
+
+// renderLayered composites a frame rendered by renderLayer into its parent,
+// on top of its shadow and blurred backdrop.
+func (x *RequestsHandler) renderLayered(frame *FrameDesc, xul, yul int, img *render.CompositeM) {
+	shape := newFrameShape(frame)
+	if hasTransform(frame) {
+		x.renderTransformed(frame, shape, xul, yul, img)
+		return
+	}
+	pos := floatgeom.Point2{float64(xul), float64(yul)}
+	if frame.Shadow != nil {
+		appendShadow(img, shape.outerMask(), frame.Shadow, pos.X(), pos.Y())
+	}
+	if frame.BackdropBlur > 0 {
+		img.AppendOffset(render.NewSprite(0, 0, backdrop(img, image.Rect(xul, yul, xul+frame.Width, yul+frame.Height), frame.BackdropBlur, shape.outerMask())), pos)
+	}
+	layer, off := x.renderLayer(frame, shape)
+	pos = floatgeom.Point2{pos.X() - float64(off.X), pos.Y() - float64(off.Y)}
+	if frame.Blur > 0 {
+		var pad int
+		layer, pad = blurImage(layer, frame.Blur)
+		pos = floatgeom.Point2{pos.X() - float64(pad), pos.Y() - float64(pad)}
+	}
+	img.AppendOffset(render.NewSprite(0, 0, layer), pos)
+}
+
+// renderLayer renders a frame with its text and subframes into a canvas and
+// returns it with the position of the frame in it. Background and background
+// image are clipped to the frame shape, text to the area inside the border.
+// Clipped subframes are cut to that area too and the border is drawn on top,
+// unclipped ones are drawn over the border on a canvas covering them.
+// Subframes are drawn over the background, so their backdrop includes it.
+func (x *RequestsHandler) renderLayer(frame *FrameDesc, shape *frameShape) (*image.RGBA, image.Point) {
+	bg := render.NewCompositeM()
+	bg.Append(backgroundSprite(frame))
+	if frame.BGimage != "" {
+		if s := x.bgImage(frame); s != nil {
+			bg.Append(s)
+		}
+	}
+	out := flattenComposite(bg, frame.Width, frame.Height)
+	applyMask(out, shape.outerMask())
+
+	content := render.NewCompositeM()
+	content.Append(render.NewSprite(0, 0, out))
+	if frame.Text != nil {
+		if frame.Text.DPI == 0 {
+			frame.Text.DPI = defaultTextDPI
+		}
+		x.drawText(frame, 0, 0, content)
+	}
+	clip := clipsSubframes(frame)
+	if clip {
+		for _, sf := range frame.Sub {
+			x.renderSubFrame(sf, sf.X, sf.Y, content)
+		}
+	}
+	full := flattenComposite(content, frame.Width, frame.Height)
+	blendMask(out, full, shape.innerMask())
+
+	if border := shape.borderImage(); border != nil {
+		draw.Draw(out, out.Bounds(), border, image.Point{}, draw.Over)
+	}
+	if clip {
+		return out, image.Point{}
+	}
+
+	r := contentRect(frame)
+	off := image.Point{}.Sub(r.Min)
+	all := render.NewCompositeM()
+	all.AppendOffset(render.NewSprite(0, 0, out), floatgeom.Point2{float64(off.X), float64(off.Y)})
+	for _, sf := range frame.Sub {
+		x.renderSubFrame(sf, off.X+sf.X, off.Y+sf.Y, all)
+	}
+	return flattenComposite(all, r.Dx(), r.Dy()), off
+}
+
+// hasText reports whether a frame or any of its subframes draws text.
+func hasText(frame *FrameDesc) bool {
+	if frame == nil {
+		return false
+	}
+	if frame.Text != nil && frame.Text.String != "" {
+		return true
+	}
+	for _, sf := range frame.Sub {
+		if hasText(sf) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidFrameField returns the name of the first field in a frame tree with
+// an unknown value, or "" if all are valid.
+func invalidFrameField(frame *FrameDesc) string {
+	if frame == nil {
+		return ""
+	}
+	if frame.Filter != "" && !isFilter(frame.Filter) {
+		return "filter"
+	}
+	if frame.BGCrop != "" && !isCropMode(frame.BGCrop) {
+		return "bgcrop"
+	}
+	if frame.BGFit != "" && !isBGFit(frame.BGFit) {
+		return "bgfit"
+	}
+	if _, ok := bgAnchors[frame.BGAnchor]; frame.BGAnchor != "" && !ok {
+		return "bganchor"
+	}
+	if frame.BGOpacity != nil && (*frame.BGOpacity < 0 || *frame.BGOpacity > 1) {
+		return "bgopacity"
+	}
+	if _, ok := cssSides(frame.BGSlice); len(frame.BGSlice) > 0 && !ok {
+		return "bgslice"
+	}
+	if !validRadius(frame.Radius) {
+		return "radius"
+	}
+	if _, ok := cssSides(frame.BorderWidth); len(frame.BorderWidth) > 0 && !ok {
+		return "borderwidth"
+	}
+	if !validBorderColors(frame.BorderColor) {
+		return "bordercolor"
+	}
+	if frame.BorderStyle != "" && !isBorderStyle(frame.BorderStyle) {
+		return "borderstyle"
+	}
+	if !validGradient(frame.Gradient) || frame.Text != nil && !validGradient(frame.Text.Gradient) {
+		return "gradient"
+	}
+	if !validShadow(frame.Shadow) || frame.Text != nil && !validShadow(frame.Text.Shadow) {
+		return "shadow"
+	}
+	if !validBlur(frame.Blur) || !validBlur(frame.BackdropBlur) {
+		return "blur"
+	}
+	if frame.Opacity != nil && (*frame.Opacity < 0 || *frame.Opacity > 1) {
+		return "opacity"
+	}
+	if frame.Scale < 0 || frame.Scale > maxFrameScale {
+		return "scale"
+	}
+	if !validOrigin(frame.Origin) {
+		return "origin"
+	}
+	if frame.Overflow != "" && !isOverflow(frame.Overflow) {
+		return "overflow"
+	}
+	for _, sf := range frame.Sub {
+		if field := invalidFrameField(sf); field != "" {
+			return field
+		}
+	}
+	return ""
+}
+
+// frameFilter returns the filter for the background image of a frame: the
+// one set on the frame, else defaultFrameFilter for frames with text and
+// plainFrameFilter for others.
+func frameFilter(frame *FrameDesc) gift.Resampling {
+	if f, ok := resamplingFilters[frame.Filter]; ok {
+		return f
+	}
+	if hasText(frame) {
+		return resamplingFilters[defaultFrameFilter]
+	}
+	return resamplingFilters[plainFrameFilter]
+}
+
 func (x *RequestsHandler) drawText(frame *FrameDesc, xbase, ybase int, img *render.CompositeM) {
 	if frame.Text == nil || frame.Text.String == "" {
 		return
@@ -188,7 +450,13 @@ func (x *RequestsHandler) drawText(frame *FrameDesc, xbase, ybase int, img *rend
 		fontName = frame.Text.Fontname + ".ttf"
 	}
 
+	// gradient text is drawn in white, then colored by its coverage
+	var fill *image.RGBA
 	clr := image.NewUniform(getColor(frame.Text.Fontcolor))
+	if frame.Text.Gradient != nil && frame.Width > 0 && frame.Height > 0 {
+		fill = GradientImage(frame.Text.Gradient, frame.Width, frame.Height)
+		clr = image.NewUniform(color.White)
+	}
 	xmax := frame.Width - frame.Text.PadX*2 - 2*frame.Thickness
 	ymax := frame.Height - frame.Text.PadY*2 - 2*frame.Thickness
 	fontFile := filepath.Join(x.Fontpath, fontName)
@@ -274,9 +542,23 @@ func (x *RequestsHandler) drawText(frame *FrameDesc, xbase, ybase int, img *rend
 
 	L().Debug("xb:", xb, "yb:", yb)
 
+	sprites := make([]*render.Sprite, len(txts))
 	for i, txt := range txts {
-		ts := txt.ToSprite()
-		img.AppendOffset(ts, floatgeom.Point2{xb, yb + float64(ts.GetRGBA().Rect.Max.Y*i)})
+		sprites[i] = txt.ToSprite()
+	}
+	// all shadows go below all lines
+	if frame.Text.Shadow != nil {
+		for i, ts := range sprites {
+			y := yb + float64(ts.GetRGBA().Rect.Max.Y*i)
+			appendShadow(img, alphaMask(ts.GetRGBA()), frame.Text.Shadow, xb, y)
+		}
+	}
+	for i, ts := range sprites {
+		y := yb + float64(ts.GetRGBA().Rect.Max.Y*i)
+		if fill != nil {
+			fillCoverage(ts.GetRGBA(), fill, image.Pt(int(xb)-xbase, int(y)-ybase))
+		}
+		img.AppendOffset(ts, floatgeom.Point2{xb, y})
 	}
 }
 
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/oakmound/oak/v3/render"
+)
+
+func TestGetColorAlpha(t *testing.T) {
+	// existing fields keep their premultiplied meaning
+	if c := getColor([]uint32{64, 0, 0, 128}); c != (color.RGBA{64, 0, 0, 128}) {
+		t.Errorf("getColor: %v", c)
+	}
+	r, _, _, a := getStraightColor([]uint32{64, 0, 0, 128}).RGBA()
+	if r>>8 != 32 || a>>8 != 128 {
+		t.Errorf("getStraightColor: premultiplied red %d, alpha %d", r>>8, a>>8)
+	}
+	if c := getStraightColor([]uint32{1, 2, 3}); c != (color.RGBA{1, 2, 3, 255}) {
+		t.Errorf("getStraightColor: %v", c)
+	}
+}
+
+// renderTestFrame renders a frame at 20, 20 into a w x h canvas.
+func renderTestFrame(x *RequestsHandler, frame *FrameDesc, w, h int) *image.RGBA {
+	c := render.NewCompositeM()
+	c.Append(render.NewColorBoxM(w, h, color.Transparent))
+	x.renderSubFrame(frame, 20, 20, c)
+	return flattenComposite(c, w, h)
+}
+
+func TestTransformedSubframes(t *testing.T) {
+	x := newTestHandler(t)
+	red, green := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}
+	for _, overflow := range []string{"", overflowVisible, overflowHidden} {
+		// the child overhangs the right edge and is turned below the parent
+		frame := &FrameDesc{
+			Width: 40, Height: 40, Background: []uint32{255, 0, 0}, Rotation: 90, Overflow: overflow,
+			Sub: []*FrameDesc{{X: 40, Width: 20, Height: 20, Background: []uint32{0, 255, 0}}},
+		}
+		img := renderTestFrame(x, frame, 100, 100)
+		if c := img.RGBAAt(40, 40); c != red {
+			t.Errorf("overflow %q: parent is %v", overflow, c)
+		}
+		want := green
+		if overflow == overflowHidden {
+			want = color.RGBA{}
+		}
+		if c := img.RGBAAt(50, 70); c != want {
+			t.Errorf("overflow %q: child is %v, want %v", overflow, c, want)
+		}
+	}
+}
+
+func TestOverhangingSubframes(t *testing.T) {
+	x := newTestHandler(t)
+	half := 0.5
+	for name, frame := range map[string]*FrameDesc{
+		"shadow":  {Shadow: &ShadowDesc{X: 2, Y: 2, Blur: 4}},
+		"opacity": {Opacity: &half},
+		"radius":  {Radius: []float64{8}},
+	} {
+		frame.Width, frame.Height, frame.Background = 40, 40, []uint32{255, 0, 0}
+		frame.Sub = []*FrameDesc{{X: 30, Y: 10, Width: 30, Height: 20, Background: []uint32{0, 255, 0}}}
+		img := renderTestFrame(x, frame, 100, 100)
+		if c := img.RGBAAt(70, 40); c.G == 0 || c.R != 0 {
+			t.Errorf("%s: overhanging child is %v", name, c)
+		}
+
+		frame.Overflow = overflowHidden
+		img = renderTestFrame(x, frame, 100, 100)
+		if c := img.RGBAAt(70, 40); c.G != 0 {
+			t.Errorf("%s, hidden: overhanging child is %v", name, c)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/gift"
+)
+
+// defaultFrameFilter is used for background images of frames containing
+// text and for their textures, where soft or aliased glyphs show most. Other
+// frames keep scaling their background images with plainFrameFilter.
+const (
+	defaultFrameFilter = "lanczos"
+	plainFrameFilter   = "nearest"
+)
+
+// kernelResampling is a gift.Resampling for filters gift doesn't provide.
+type kernelResampling struct {
+	support float32
+	kernel  func(float32) float32
+}
+
+func (r kernelResampling) Support() float32         { return r.support }
+func (r kernelResampling) Kernel(x float32) float32 { return r.kernel(x) }
+
+func sincf(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// mitchellResampling is the Mitchell-Netravali cubic with B = C = 1/3.
+var mitchellResampling = kernelResampling{
+	support: 2,
+	kernel: func(x float32) float32 {
+		t := math.Abs(float64(x))
+		const b, c = 1.0 / 3, 1.0 / 3
+		switch {
+		case t < 1:
+			return float32(((12-9*b-6*c)*t*t*t + (-18+12*b+6*c)*t*t + (6 - 2*b)) / 6)
+		case t < 2:
+			return float32(((-b-6*c)*t*t*t + (6*b+30*c)*t*t + (-12*b-48*c)*t + (8*b + 24*c)) / 6)
+		}
+		return 0
+	},
+}
+
+var lanczos2Resampling = kernelResampling{
+	support: 2,
+	kernel: func(x float32) float32 {
+		t := math.Abs(float64(x))
+		if t < 2 {
+			return float32(sincf(t) * sincf(t/2))
+		}
+		return 0
+	},
+}
+
+// resamplingFilters maps the filter names accepted in texture sizes, uploads
+// and frames. bilinear, bicubic and lanczos3 are kept for configurations
+// written for the previous resize library.
+var resamplingFilters = map[string]gift.Resampling{
+	"nearest":    gift.NearestNeighborResampling,
+	"box":        gift.BoxResampling,
+	"linear":     gift.LinearResampling,
+	"bilinear":   gift.LinearResampling,
+	"catmullrom": gift.CubicResampling,
+	"cubic":      gift.CubicResampling,
+	"bicubic":    gift.CubicResampling,
+	"mitchell":   mitchellResampling,
+	"lanczos":    gift.LanczosResampling,
+	"lanczos3":   gift.LanczosResampling,
+	"lanczos2":   lanczos2Resampling,
+}
+
+func isFilter(name string) bool {
+	_, ok := resamplingFilters[name]
+	return ok
+}
+
+// resampleToFit scales an image down to fit into w x h keeping its aspect
+// ratio. Images already fitting are returned as they are.
+func resampleToFit(img image.Image, w, h int, filter gift.Resampling) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= w && b.Dy() <= h {
+		return img
+	}
+	size := gift.New(gift.ResizeToFit(w, h, filter)).Bounds(b).Size()
+	return resampleLinear(img, size.X, size.Y, filter)
+}
+
+// textureFilter returns the filter for the textures of an image: the one
+// stored with the image, else the one of the bucket.
+func (x *RequestsHandler) textureFilter(ID string, b *TextureBucket) gift.Resampling {
+	if f, ok := x.storedFilter(ID); ok {
+		return f
+	}
+	return b.filter()
+}
+
+// mipFilter returns the filter for level 0 of the mip chains of an image: the
+// one stored with the image, else lanczos.
+func (x *RequestsHandler) mipFilter(ID string) gift.Resampling {
+	if f, ok := x.storedFilter(ID); ok {
+		return f
+	}
+	return gift.LanczosResampling
+}
+
+func (x *RequestsHandler) storedFilter(ID string) (gift.Resampling, bool) {
+	if am, err := x.LoadAssetMeta(ID); !check_error(err) && isFilter(am.Filter) {
+		return resamplingFilters[am.Filter], true
+	}
+	return nil, false
+}
+
+// SetTextureFilter stores the filter used for all textures of an image.
+// Nothing is stored for an empty filter. If the filter changes, textures made
+// with the old one are dropped, they are recreated on demand.
+func (x *RequestsHandler) SetTextureFilter(ID string, filter string) error {
+	if filter == "" {
+		return nil
+	}
+	am, err := x.LoadAssetMeta(ID)
+	if err != nil {
+		return err
+	}
+	if am.Filter == filter {
+		return nil
+	}
+	if _, err = x.UpdateAssetMeta(ID, func(m *AssetMeta) { m.Filter = filter }); err != nil {
+		return err
+	}
+	x.dropTextures(ID)
+	return nil
+}
+
+// srgbDecode maps 8-bit sRGB values to linear light, srgbEncode maps linear
+// light quantized to srgbEncodeSteps back to 8-bit sRGB.
+var (
+	srgbDecode [256]float32
+	srgbEncode [srgbEncodeSteps + 1]uint8
+)
+
+const srgbEncodeSteps = 1 << 16
+
+func init() {
+	for i := range srgbDecode {
+		v := float64(i) / 255
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		srgbDecode[i] = float32(v)
+	}
+	for i := range srgbEncode {
+		v := float64(i) / srgbEncodeSteps
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		srgbEncode[i] = uint8(math.Round(v * 255))
+	}
+}
+
+type resampleWeights struct {
+	start int
+	w     []float32
+}
+
+// resampleWeightsFor computes the filter taps of every destination pixel
+// along one axis. The filter is widened by the scale factor when
+// downscaling, so every source pixel contributes.
+func resampleWeightsFor(dst, src int, filter gift.Resampling) []resampleWeights {
+	scale := float64(src) / float64(dst)
+	fscale := math.Max(scale, 1)
+	support := float64(filter.Support()) * fscale
+	res := make([]resampleWeights, dst)
+	for i := range res {
+		center := (float64(i) + 0.5) * scale
+		if support <= 0 {
+			res[i] = resampleWeights{start: minInt(int(center), src-1), w: []float32{1}}
+			continue
+		}
+		lo := maxInt(0, int(math.Floor(center-support)))
+		hi := minInt(src, int(math.Ceil(center+support)))
+		ws := make([]float32, hi-lo)
+		var sum float32
+		for j := lo; j < hi; j++ {
+			ws[j-lo] = filter.Kernel(float32((float64(j) + 0.5 - center) / fscale))
+			sum += ws[j-lo]
+		}
+		if sum == 0 {
+			res[i] = resampleWeights{start: minInt(int(center), src-1), w: []float32{1}}
+			continue
+		}
+		for k := range ws {
+			ws[k] /= sum
+		}
+		res[i] = resampleWeights{start: lo, w: ws}
+	}
+	return res
+}
+
+// resampleLinear resizes an image in linear light on premultiplied alpha, so
+// gradients keep their brightness and transparent pixels don't bleed their
+// color into the edges of opaque ones.
+func resampleLinear(img image.Image, w, h int, filter gift.Resampling) *image.NRGBA {
+	return resampleWith(img, w, h, filter, decodeLinear, encodeLinear)
+}
+
+// decodeLinear converts a straight alpha sRGB pixel to linear premultiplied
+// values.
+func decodeLinear(p []uint8, c []float32) {
+	a := float32(p[3]) / 255
+	c[0] = srgbDecode[p[0]] * a
+	c[1] = srgbDecode[p[1]] * a
+	c[2] = srgbDecode[p[2]] * a
+	c[3] = a
+}
+
+// encodeLinear converts linear premultiplied values back to a straight alpha
+// sRGB pixel.
+func encodeLinear(c []float32, d []uint8) {
+	a := clampUnit(c[3])
+	if a == 0 {
+		return
+	}
+	d[0] = srgbEncode[int(clampUnit(c[0]/a)*srgbEncodeSteps+0.5)]
+	d[1] = srgbEncode[int(clampUnit(c[1]/a)*srgbEncodeSteps+0.5)]
+	d[2] = srgbEncode[int(clampUnit(c[2]/a)*srgbEncodeSteps+0.5)]
+	d[3] = uint8(a*255 + 0.5)
+}
+
+// resampleWith resizes an image separably, filtering the values decode
+// yields for every pixel and storing them with encode.
+func resampleWith(img image.Image, w, h int, filter gift.Resampling, decode func([]uint8, []float32), encode func([]float32, []uint8)) *image.NRGBA {
+	src, ok := img.(*image.NRGBA)
+	if !ok {
+		src = image.NewNRGBA(img.Bounds())
+		draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	wx := resampleWeightsFor(w, sw, filter)
+	wy := resampleWeightsFor(h, sh, filter)
+
+	// horizontal pass into decoded rows
+	tmp := make([]float32, w*sh*4)
+	row := make([]float32, sw*4)
+	for y := 0; y < sh; y++ {
+		p := src.Pix[src.PixOffset(sb.Min.X, sb.Min.Y+y):]
+		for x := 0; x < sw; x++ {
+			decode(p[x*4:x*4+4], row[x*4:x*4+4])
+		}
+		t := tmp[y*w*4:]
+		for x, wt := range wx {
+			var c [4]float32
+			for k, f := range wt.w {
+				i := (wt.start + k) * 4
+				c[0] += row[i] * f
+				c[1] += row[i+1] * f
+				c[2] += row[i+2] * f
+				c[3] += row[i+3] * f
+			}
+			copy(t[x*4:x*4+4], c[:])
+		}
+	}
+
+	// vertical pass, then back to stored values
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y, wt := range wy {
+		d := dst.Pix[y*dst.Stride:]
+		for x := 0; x < w; x++ {
+			var c [4]float32
+			for k, f := range wt.w {
+				i := ((wt.start+k)*w + x) * 4
+				c[0] += tmp[i] * f
+				c[1] += tmp[i+1] * f
+				c[2] += tmp[i+2] * f
+				c[3] += tmp[i+3] * f
+			}
+			encode(c[:], d[x*4:x*4+4])
+		}
+	}
+	return dst
+}
+
+func clampUnit(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
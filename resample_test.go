@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/gift"
+)
+
+// resampleSRGB is the naive reference: the stored sRGB values with straight
+// alpha are filtered as they are.
+func resampleSRGB(img image.Image, w, h int, filter gift.Resampling) *image.NRGBA {
+	decode := func(p []uint8, c []float32) {
+		for i := range c {
+			c[i] = float32(p[i]) / 255
+		}
+	}
+	encode := func(c []float32, d []uint8) {
+		for i := range d {
+			d[i] = uint8(clampUnit(c[i])*255 + 0.5)
+		}
+	}
+	return resampleWith(img, w, h, filter, decode, encode)
+}
+
+// edgeTestImage is w x h, fill left of column edge and bg right of it.
+func edgeTestImage(w, h, edge int, fill, bg color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < edge {
+				img.SetNRGBA(x, y, fill)
+			} else {
+				img.SetNRGBA(x, y, bg)
+			}
+		}
+	}
+	return img
+}
+
+// checkRow compares the first row of an image with golden pixels.
+func checkRow(t *testing.T, name string, img *image.NRGBA, want []color.NRGBA) {
+	t.Helper()
+	for x, w := range want {
+		if got := img.NRGBAAt(x, 0); got != w {
+			t.Errorf("%s: pixel %d is %v, want %v", name, x, got, w)
+		}
+	}
+}
+
+func TestResampleHardEdge(t *testing.T) {
+	white, black := color.NRGBA{255, 255, 255, 255}, color.NRGBA{0, 0, 0, 255}
+	src := edgeTestImage(8, 2, 3, white, black)
+
+	// the edge pixel covers one white and one black pixel, half the light
+	linear := resampleLinear(src, 4, 1, gift.BoxResampling)
+	checkRow(t, "linear", linear, []color.NRGBA{white, {188, 188, 188, 255}, black, black})
+	srgb := resampleSRGB(src, 4, 1, gift.BoxResampling)
+	checkRow(t, "srgb", srgb, []color.NRGBA{white, {128, 128, 128, 255}, black, black})
+}
+
+func TestResampleTransparentBorder(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	// the naive edge pixel darkens or takes the color of transparent pixels
+	for _, tc := range []struct{ bg, fringe color.NRGBA }{
+		{color.NRGBA{0, 0, 0, 0}, color.NRGBA{128, 0, 0, 128}},
+		{color.NRGBA{0, 255, 0, 0}, color.NRGBA{128, 128, 0, 128}},
+	} {
+		bg := tc.bg
+		src := edgeTestImage(8, 2, 3, red, bg)
+
+		// the edge pixel is half covered by red, transparent pixels don't
+		// add their color
+		linear := resampleLinear(src, 4, 1, gift.BoxResampling)
+		checkRow(t, "linear", linear, []color.NRGBA{red, {255, 0, 0, 128}, {}, {}})
+		srgb := resampleSRGB(src, 4, 1, gift.BoxResampling)
+		checkRow(t, "srgb", srgb, []color.NRGBA{red, tc.fringe, bg, bg})
+
+		// no fringes even where the kernel rings
+		src = edgeTestImage(16, 16, 7, red, bg)
+		for _, f := range []string{"linear", "mitchell", "lanczos"} {
+			out := resampleLinear(src, 5, 5, resamplingFilters[f])
+			for x := 0; x < 5; x++ {
+				if c := out.NRGBAAt(x, 2); c.A > 0 && (c.R != 255 || c.G != 0 || c.B != 0) {
+					t.Errorf("%s over %v: pixel %d is %v", f, bg, x, c)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+	"github.com/hashicorp/golang-lru"
+)
+
+const (
+	cropSmart = "smart"
+
+	maxCropEdge = 4096
+	// maxCropFiles is the number of crops kept on disk, they are made for any
+	// requested size
+	maxCropFiles = 1024
+	// smartCropAnalysisEdge is the longer edge of the downscaled copy the
+	// saliency is computed on
+	smartCropAnalysisEdge = 256
+	// smartCropCell is the edge of the cells the local entropy is taken over
+	smartCropCell = 8
+	// weights of the saliency terms, edges are in [0, ~4], saturation and
+	// normalized entropy in [0, 1]
+	smartCropSaturation = 0.5
+	smartCropEntropy    = 0.5
+)
+
+// CropRect is a crop in pixels of the full image.
+type CropRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+func (c CropRect) rect() image.Rectangle {
+	return image.Rect(c.X, c.Y, c.X+c.W, c.Y+c.H)
+}
+
+func isCropMode(mode string) bool {
+	return mode == cropSmart
+}
+
+// cropAspectKey is the reduced aspect ratio a smart crop is cached under.
+func cropAspectKey(w, h int) string {
+	a, b := w, h
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return strconv.Itoa(w/a) + ":" + strconv.Itoa(h/a)
+}
+
+// cropSize returns the largest size of the given aspect fitting into iw x ih.
+func cropSize(iw, ih, w, h int) (int, int) {
+	if iw*h > ih*w {
+		return maxInt(1, minInt(iw, int(math.Round(float64(ih*w)/float64(h))))), ih
+	}
+	return iw, maxInt(1, minInt(ih, int(math.Round(float64(iw*h)/float64(w)))))
+}
+
+// saliencyMap rates every pixel of an image by its edge strength, its
+// saturation and the luminance entropy of its neighbourhood, weighted by
+// alpha. Flat areas score low, detailed and colorful ones high.
+func saliencyMap(img *image.NRGBA) []float64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	lum := make([]float64, w*h)
+	sal := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+			r, g, bl := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+			a := float64(c.A) / 255
+			lum[y*w+x] = (0.299*r + 0.587*g + 0.114*bl) * a
+			hi, lo := math.Max(r, math.Max(g, bl)), math.Min(r, math.Min(g, bl))
+			if hi > 0 {
+				sal[y*w+x] = smartCropSaturation * (hi - lo) / hi * a
+			}
+		}
+	}
+	at := func(x, y int) float64 {
+		return lum[minInt(maxInt(y, 0), h-1)*w+minInt(maxInt(x, 0), w-1)]
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx := (at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1)) - (at(x-1, y-1) + 2*at(x-1, y) + at(x-1, y+1))
+			dy := (at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1)) - (at(x-1, y-1) + 2*at(x, y-1) + at(x+1, y-1))
+			sal[y*w+x] += math.Sqrt(dx*dx + dy*dy)
+		}
+	}
+	for cy := 0; cy < h; cy += smartCropCell {
+		for cx := 0; cx < w; cx += smartCropCell {
+			var hist [16]int
+			n := 0
+			for y := cy; y < minInt(cy+smartCropCell, h); y++ {
+				for x := cx; x < minInt(cx+smartCropCell, w); x++ {
+					hist[minInt(int(lum[y*w+x]*16), 15)]++
+					n++
+				}
+			}
+			e := 0.0
+			for _, k := range hist {
+				if k > 0 {
+					p := float64(k) / float64(n)
+					e -= p * math.Log2(p)
+				}
+			}
+			e = smartCropEntropy * e / 4
+			for y := cy; y < minInt(cy+smartCropCell, h); y++ {
+				for x := cx; x < minInt(cx+smartCropCell, w); x++ {
+					sal[y*w+x] += e
+				}
+			}
+		}
+	}
+	return sal
+}
+
+// SmartCrop returns the largest w:h crop of an image covering the most
+// salient region. The window only slides along the axis the image is too
+// long in; ties are resolved towards the center, so the result only depends
+// on the pixels.
+func SmartCrop(img image.Image, w, h int) CropRect {
+	b := img.Bounds()
+	iw, ih := b.Dx(), b.Dy()
+	cw, ch := cropSize(iw, ih, w, h)
+	if cw == iw && ch == ih {
+		return CropRect{W: iw, H: ih}
+	}
+
+	small := resampleToFit(img, smartCropAnalysisEdge, smartCropAnalysisEdge, gift.BoxResampling)
+	nimg, ok := small.(*image.NRGBA)
+	if !ok {
+		nimg = image.NewNRGBA(small.Bounds().Sub(small.Bounds().Min))
+		draw.Draw(nimg, nimg.Bounds(), small, small.Bounds().Min, draw.Src)
+	}
+	sw, sh := nimg.Bounds().Dx(), nimg.Bounds().Dy()
+	sal := saliencyMap(nimg)
+
+	// profile of the saliency along the sliding axis
+	horizontal := cw < iw
+	n, long, window := sh, ih, ch
+	if horizontal {
+		n, long, window = sw, iw, cw
+	}
+	profile := make([]float64, n+1)
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			i := y
+			if horizontal {
+				i = x
+			}
+			profile[i+1] += sal[y*sw+x]
+		}
+	}
+	for i := 1; i <= n; i++ {
+		profile[i] += profile[i-1]
+	}
+
+	scale := float64(n) / float64(long)
+	sWindow := minInt(n, maxInt(1, int(math.Round(float64(window)*scale))))
+	center := float64(n-sWindow) / 2
+	best, bestScore := 0, -1.0
+	for p := 0; p+sWindow <= n; p++ {
+		score := profile[p+sWindow] - profile[p]
+		if score > bestScore+1e-9 || math.Abs(score-bestScore) <= 1e-9 && math.Abs(float64(p)-center) < math.Abs(float64(best)-center) {
+			best, bestScore = p, score
+		}
+	}
+	off := minInt(long-window, maxInt(0, int(math.Round(float64(best)/scale))))
+	if horizontal {
+		return CropRect{X: off, W: cw, H: ch}
+	}
+	return CropRect{Y: off, W: cw, H: ch}
+}
+
+// smartCrop returns the smart crop of a stored image for an aspect ratio,
+// computing it on first use and caching it in the asset metadata.
+func (x *RequestsHandler) smartCrop(ID string, img image.Image, w, h int) (CropRect, error) {
+	key := cropAspectKey(w, h)
+	if am, err := x.LoadAssetMeta(ID); err != nil {
+		return CropRect{}, err
+	} else if c, ok := am.Crops[key]; ok {
+		return c, nil
+	}
+	c := SmartCrop(img, w, h)
+	_, err := x.UpdateAssetMeta(ID, func(m *AssetMeta) {
+		if m.Crops == nil {
+			m.Crops = make(map[string]CropRect)
+		}
+		m.Crops[key] = c
+	})
+	return c, err
+}
+
+// cropImage returns the part of an image inside c, relative to its bounds.
+func cropImage(img image.Image, c CropRect) image.Image {
+	r := c.rect().Add(img.Bounds().Min)
+	if s, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, c.W, c.H))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// WriteSmartCrop stores the smart crop of an image scaled to w x h.
+func (x *RequestsHandler) WriteSmartCrop(ID string, fpath string, w, h int) error {
+	img, err := x.LoadFull(ID)
+	if err != nil {
+		return err
+	}
+	c, err := x.smartCrop(ID, img, w, h)
+	if err != nil {
+		return err
+	}
+	if x.isNormalMap(ID) {
+		return x.SaveWriteToPNG(fpath, resampleNormals(cropImage(img, c), w, h, resamplingFilters[defaultFrameFilter]))
+	}
+	out := resampleLinear(cropImage(img, c), w, h, resamplingFilters[defaultFrameFilter])
+	return x.SaveWriteTexture(fpath, out, x.textureQuality(ID))
+}
+
+// presentSmartCrop returns the smart crop of an image in the requested size,
+// creating it on first use. As crops are deterministic, the result is stored
+// under the image hash and size. Only the last maxCropFiles used are kept.
+func (x *RequestsHandler) presentSmartCrop(ID *string, w, h int) (*MetaDef, *string) {
+	key := cropKey(*ID, w, h)
+	fpath := x.ImPathCrop + key
+	if _, ok := x.CropFiles.Get(fpath); ok {
+		if meta0, ok := x.ImageMapCrop.Get(key); ok {
+			L().Debug(key + " is already in the map")
+			return meta0.(*MetaDef), &fpath
+		}
+	}
+
+	reader, err := os.Open(fpath)
+	if err != nil {
+		if res, _ := x.present(ID); res == nil {
+			return nil, nil
+		}
+		L().Debug(*ID+" : smart crop ", w, "x", h)
+		if check_error(x.WriteSmartCrop(*ID, fpath, w, h)) {
+			return nil, nil
+		}
+		if reader, err = os.Open(fpath); check_error(err) {
+			return nil, nil
+		}
+	}
+	defer reader.Close()
+
+	meta := x.decodeMeta(reader, *ID)
+	x.CropKeys.add(*ID, key)
+	x.ImageMapCrop.Add(key, meta)
+	x.CropFiles.Add(fpath, nil)
+	return meta, &fpath
+}
+
+// cropSep separates the hash and the size in the names of smart crops.
+const cropSep = "_"
+
+func cropKey(ID string, w, h int) string {
+	return ID + cropSep + strconv.Itoa(w) + "x" + strconv.Itoa(h)
+}
+
+// newCropMetaCache returns the cache of crop MetaDefs, which keeps CropKeys in
+// sync with its entries.
+func (x *RequestsHandler) newCropMetaCache() *lru.Cache {
+	c, _ := lru.NewWithEvict(defaultCacheSize, func(k, _ interface{}) {
+		key := k.(string)
+		x.CropKeys.remove(key[:strings.Index(key, cropSep)], key)
+	})
+	return c
+}
+
+// dropSmartCrops removes the crops made before a restart, which are not
+// tracked by the cache.
+func (x *RequestsHandler) dropSmartCrops() {
+	files, err := ioutil.ReadDir(x.ImPathCrop)
+	if check_error(err) {
+		return
+	}
+	for _, f := range files {
+		check_error(os.Remove(x.ImPathCrop + f.Name()))
+	}
+}
+
+// cropRequestSize parses the width/height query of a crop, both are required.
+func cropRequestSize(qw, qh string) (int, int, bool) {
+	w, err1 := strconv.Atoi(qw)
+	h, err2 := strconv.Atoi(qh)
+	if err1 != nil || err2 != nil || w < 1 || h < 1 || w > maxCropEdge || h > maxCropEdge {
+		return 0, 0, false
+	}
+	return w, h, true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func TestSmartCropFilesLimited(t *testing.T) {
+	x := newTestHandler(t)
+	x.CropFiles = newFileCache(2)
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, noiseTestImage(120, 80)); err != nil {
+		t.Fatal(err)
+	}
+	err, ID := x.ProcessImage(enc.Bytes(), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, w := range []int{10, 20, 30} {
+		_, fpath := x.presentSmartCrop(&ID, w, 10)
+		if fpath == nil {
+			t.Fatalf("no crop of width %d", w)
+		}
+		paths = append(paths, *fpath)
+	}
+	if fileExists(paths[0]) {
+		t.Error("least recently used crop kept")
+	}
+	for _, p := range paths[1:] {
+		if !fileExists(p) {
+			t.Errorf("%s removed", p)
+		}
+	}
+	// an evicted crop is made again even though its MetaDef is cached
+	if _, fpath := x.presentSmartCrop(&ID, 10, 10); fpath == nil || !fileExists(*fpath) {
+		t.Error("evicted crop not recreated")
+	}
+}
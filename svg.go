@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+const (
+	defaultSVGSize = 512
+	maxSVGEdge     = 8192
+	// maxSVGRasters is the number of rasterizations kept on disk, they are
+	// made for any requested size
+	maxSVGRasters = 256
+)
+
+// svgCSP keeps SVGs opened from our origin from running scripts or loading
+// anything, should the sanitizer miss something.
+const svgCSP = "default-src 'none'; style-src 'unsafe-inline'"
+
+// svgAnimationElements can set attributes, which must not target links.
+var svgAnimationElements = map[string]bool{
+	"animate":          true,
+	"animatemotion":    true,
+	"animatetransform": true,
+	"set":              true,
+}
+
+// svgForbiddenElements are dropped together with their whole subtree.
+var svgForbiddenElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"object":        true,
+	"embed":         true,
+	"audio":         true,
+	"video":         true,
+	"handler":       true,
+	"listener":      true,
+}
+
+var (
+	svgURLRe    = regexp.MustCompile(`(?i)url\(\s*['"]?\s*([^'")\s]*)[^)]*\)`)
+	svgImportRe = regexp.MustCompile(`(?i)@import[^;]*;?`)
+	svgInlineRe = regexp.MustCompile(`(?i)^data:image/(png|jpeg|gif|webp);`)
+	svgEscaper  = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+// isSVG reports whether the data is an XML document with an svg root element.
+func isSVG(src []byte) bool {
+	head := bytes.TrimSpace(src)
+	if len(head) == 0 || head[0] != '<' {
+		return false
+	}
+	d := xml.NewDecoder(bytes.NewReader(src))
+	d.Strict = false
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			return false
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return strings.EqualFold(se.Name.Local, "svg")
+		}
+	}
+}
+
+// svgLocalRef reports whether a reference points into the document itself
+// or to inline raster data, the only references kept by sanitizeSVG.
+func svgLocalRef(ref string) bool {
+	ref = strings.TrimSpace(ref)
+	return strings.HasPrefix(ref, "#") || svgInlineRe.MatchString(ref)
+}
+
+// svgAnimatesHref reports whether an animation element sets a link, which
+// can turn it into a javascript: URL.
+func svgAnimatesHref(se xml.StartElement) bool {
+	if !svgAnimationElements[strings.ToLower(se.Name.Local)] {
+		return false
+	}
+	for _, a := range se.Attr {
+		if strings.EqualFold(a.Name.Local, "attributeName") {
+			name := strings.TrimSpace(a.Value)
+			if i := strings.LastIndex(name, ":"); i >= 0 {
+				name = name[i+1:]
+			}
+			if strings.EqualFold(name, "href") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sanitizeSVGStyle drops @import rules and url() references to anything but
+// local fragments.
+func sanitizeSVGStyle(style string) string {
+	style = svgImportRe.ReplaceAllString(style, "")
+	return svgURLRe.ReplaceAllStringFunc(style, func(m string) string {
+		if svgLocalRef(svgURLRe.FindStringSubmatch(m)[1]) {
+			return m
+		}
+		return "none"
+	})
+}
+
+func svgQName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// sanitizeSVG rewrites an SVG document without scripts, event handlers,
+// animated links, embedded foreign content, processing instructions, DTDs and
+// references to external resources.
+func sanitizeSVG(src []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(src))
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+	skip := 0
+	depth := 0
+	inStyle := false
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := t.(type) {
+		case xml.StartElement:
+			if depth == 0 && !strings.EqualFold(tok.Name.Local, "svg") {
+				return nil, errors.New("svg: root element is not svg")
+			}
+			depth++
+			if skip > 0 || svgForbiddenElements[strings.ToLower(tok.Name.Local)] || svgAnimatesHref(tok) {
+				skip++
+				continue
+			}
+			inStyle = strings.EqualFold(tok.Name.Local, "style")
+			out.WriteString("<" + svgQName(tok.Name))
+			for _, a := range tok.Attr {
+				name := strings.ToLower(a.Name.Local)
+				value := a.Value
+				switch {
+				case strings.HasPrefix(name, "on"):
+					continue
+				case name == "href" || name == "src":
+					if !svgLocalRef(value) {
+						continue
+					}
+				case name == "style":
+					value = sanitizeSVGStyle(value)
+				default:
+					if strings.Contains(strings.ToLower(value), "url(") {
+						value = sanitizeSVGStyle(value)
+					}
+				}
+				out.WriteString(" " + svgQName(a.Name) + `="` + svgEscaper.Replace(value) + `"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			depth--
+			if skip > 0 {
+				skip--
+				continue
+			}
+			inStyle = false
+			out.WriteString("</" + svgQName(tok.Name) + ">")
+		case xml.CharData:
+			if skip > 0 || depth == 0 {
+				continue
+			}
+			if inStyle {
+				tok = xml.CharData(sanitizeSVGStyle(string(tok)))
+			}
+			out.WriteString(svgEscaper.Replace(string(tok)))
+		}
+		// comments, processing instructions and directives are dropped
+	}
+	if depth != 0 {
+		return nil, errors.New("svg: unbalanced document")
+	}
+	return out.Bytes(), nil
+}
+
+// svgUnits are the absolute CSS units in pixels.
+var svgUnits = map[string]float64{
+	"":   1,
+	"px": 1,
+	"pt": 96.0 / 72,
+	"pc": 16,
+	"mm": 96 / 25.4,
+	"cm": 96 / 2.54,
+	"in": 96,
+}
+
+// svgLength parses an absolute length in pixels. Percentages and relative
+// units are not.
+func svgLength(s string) (float64, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	i := len(s)
+	for i > 0 && s[i-1] >= 'a' && s[i-1] <= 'z' {
+		i--
+	}
+	unit, ok := svgUnits[s[i:]]
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return v * unit, true
+}
+
+// svgRoot returns the width and height attributes of the root element, 0 if
+// missing or not absolute, and its viewBox, zero if missing or invalid. The
+// viewBox is parsed here as oksvg drops it if width or height have units.
+func svgRoot(src []byte) (w, h float64, vb [4]float64) {
+	d := xml.NewDecoder(bytes.NewReader(src))
+	d.Strict = false
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			return
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, a := range se.Attr {
+			switch strings.ToLower(a.Name.Local) {
+			case "width":
+				w, _ = svgLength(a.Value)
+			case "height":
+				h, _ = svgLength(a.Value)
+			case "viewbox":
+				f := strings.FieldsFunc(a.Value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' })
+				if len(f) != 4 {
+					continue
+				}
+				var v [4]float64
+				valid := true
+				for i, s := range f {
+					if v[i], err = strconv.ParseFloat(s, 64); err != nil {
+						valid = false
+					}
+				}
+				if valid && v[2] > 0 && v[3] > 0 {
+					vb = v
+				}
+			}
+		}
+		return
+	}
+}
+
+// svgSize returns the intrinsic size of an SVG document: its width and
+// height, else the size of its viewBox. A single given edge takes the other
+// from the aspect ratio of the viewBox.
+func svgSize(src []byte) (int, int, error) {
+	if _, err := oksvg.ReadIconStream(bytes.NewReader(src), oksvg.IgnoreErrorMode); err != nil {
+		return 0, 0, err
+	}
+	w, h, vb := svgRoot(src)
+	vw, vh := vb[2], vb[3]
+	switch {
+	case w > 0 && h > 0:
+	case w > 0 && vw > 0 && vh > 0:
+		h = w * vh / vw
+	case h > 0 && vw > 0 && vh > 0:
+		w = h * vw / vh
+	default:
+		w, h = vw, vh
+	}
+	if w <= 0 || h <= 0 {
+		return defaultSVGSize, defaultSVGSize, nil
+	}
+	return int(math.Ceil(w)), int(math.Ceil(h)), nil
+}
+
+// rasterizeSVG renders an SVG document into an image of the given size.
+func rasterizeSVG(src []byte, w, h int) (*image.RGBA, error) {
+	if w <= 0 || h <= 0 || w > maxSVGEdge || h > maxSVGEdge {
+		return nil, errors.New("svg: invalid raster size")
+	}
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(src), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	if icon.ViewBox.W <= 0 || icon.ViewBox.H <= 0 {
+		vw, vh, vb := svgRoot(src)
+		switch {
+		case vb[2] > 0:
+			icon.ViewBox.X, icon.ViewBox.Y, icon.ViewBox.W, icon.ViewBox.H = vb[0], vb[1], vb[2], vb[3]
+		case vw > 0 && vh > 0:
+			icon.ViewBox.W, icon.ViewBox.H = vw, vh
+		default:
+			icon.ViewBox.W, icon.ViewBox.H = defaultSVGSize, defaultSVGSize
+		}
+	}
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return img, nil
+}
+
+// clampSVGSize scales a raster size down to fit within maxSVGEdge.
+func clampSVGSize(w, h int) (int, int) {
+	edge := w
+	if h > edge {
+		edge = h
+	}
+	if edge <= maxSVGEdge {
+		return w, h
+	}
+	scl := float64(maxSVGEdge) / float64(edge)
+	return int(math.Max(1, math.Floor(float64(w)*scl))), int(math.Max(1, math.Floor(float64(h)*scl)))
+}
+
+// svgRequestSize resolves the width/height query of getImage, filling in a
+// missing edge from the aspect ratio of the document.
+func svgRequestSize(w, h int, qw, qh string) (int, int, error) {
+	var rw, rh int
+	var err error
+	if qw != "" {
+		if rw, err = strconv.Atoi(qw); err != nil {
+			return 0, 0, err
+		}
+	}
+	if qh != "" {
+		if rh, err = strconv.Atoi(qh); err != nil {
+			return 0, 0, err
+		}
+	}
+	switch {
+	case rw == 0 && rh == 0:
+		rw, rh = w, h
+	case rh == 0:
+		rh = int(math.Max(1, math.Round(float64(rw)*float64(h)/float64(w))))
+	case rw == 0:
+		rw = int(math.Max(1, math.Round(float64(rh)*float64(w)/float64(h))))
+	}
+	if rw <= 0 || rh <= 0 || rw > maxSVGEdge || rh > maxSVGEdge {
+		return 0, 0, errors.New("svg: invalid raster size")
+	}
+	return rw, rh, nil
+}
+
+func (x *RequestsHandler) svgSource(ID string) ([]byte, bool) {
+	src, err := ioutil.ReadFile(x.ImPathSVG + ID)
+	if err != nil {
+		return nil, false
+	}
+	return src, true
+}
+
+// ProcessSVG stores the sanitized source of an SVG upload together with a
+// PNG rasterization in its intrinsic size, which everything else that reads
+// full images (frames, textures of old data) uses.
+func (x *RequestsHandler) ProcessSVG(src []byte) (error, string) {
+	clean, err := sanitizeSVG(src)
+	if err != nil {
+		return err, ""
+	}
+	w, h, err := svgSize(clean)
+	if err != nil {
+		return err, ""
+	}
+	w, h = clampSVGSize(w, h)
+	img, err := rasterizeSVG(clean, w, h)
+	if err != nil {
+		return err, ""
+	}
+
+	ID := GetMD5HashByte(clean)
+	if err = x.SaveWriteToFile(x.ImPathSVG+ID, clean); err != nil {
+		return err, ""
+	}
+	if err = x.SaveWriteToPNG(x.ImPathF+ID, img); err != nil {
+		return err, ""
+	}
+	if _, err = x.WriteImageMeta(ID, img); err != nil {
+		return err, ""
+	}
+	for _, v := range x.Tprecalcs {
+		if err = x.WriteSVGScaled(ID, clean, v); err != nil {
+			return err, ""
+		}
+	}
+	L().Info("Hash:", ID)
+	return nil, ID
+}
+
+// WriteSVGScaled rasterizes the vector source directly at the texture size,
+// including sizes above the intrinsic size of the document.
+func (x *RequestsHandler) WriteSVGScaled(base string, src []byte, rsize string) error {
+	size, ok := x.Tsizes[rsize]
+	if !ok {
+		return errors.New("Not such size defined in the size map")
+	}
+	w, h, err := svgSize(src)
+	if err != nil {
+		return err
+	}
+	w, h = clampSVGSize(size.ScaledSize(w, h))
+	img, err := rasterizeSVG(src, w, h)
+	if err != nil {
+		return err
+	}
+	return x.SaveWriteToPNG(x.ImPathS[rsize]+base, img)
+}
+
+// presentSVGRaster returns a PNG rasterization of an SVG in the requested
+// size, caching it next to the source. Only the last maxSVGRasters used are
+// kept.
+func (x *RequestsHandler) presentSVGRaster(ID string, w, h int) (*MetaDef, *string) {
+	fpath := x.ImPathSVG + ID + svgRasterSep + strconv.Itoa(w) + "x" + strconv.Itoa(h)
+	defer x.SVGRasters.Add(fpath, nil)
+	if !fileExists(fpath) {
+		src, ok := x.svgSource(ID)
+		if !ok {
+			return nil, nil
+		}
+		img, err := rasterizeSVG(src, w, h)
+		if check_error(err) {
+			return nil, nil
+		}
+		if check_error(x.SaveWriteToPNG(fpath, img)) {
+			return nil, nil
+		}
+	}
+	return &MetaDef{W: w, H: h, mime: "image/png"}, &fpath
+}
+
+// svgRasterSep separates the hash and the size in the names of rasterized
+// SVGs.
+const svgRasterSep = "_"
+
+// dropSVGRasters removes the rasterizations made before a restart, which are
+// not tracked by the cache.
+func (x *RequestsHandler) dropSVGRasters() {
+	files, err := ioutil.ReadDir(x.ImPathSVG)
+	if check_error(err) {
+		return
+	}
+	for _, f := range files {
+		if strings.Contains(f.Name(), svgRasterSep) {
+			check_error(os.Remove(x.ImPathSVG + f.Name()))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/oakmound/oak/v3/alg/floatgeom"
+	"github.com/oakmound/oak/v3/render"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// maxFrameScale limits the scale of frames, the canvas of a scaled frame grows
+// with it.
+const maxFrameScale = 10
+
+func validOrigin(origin []float64) bool {
+	return len(origin) == 0 || len(origin) == 2
+}
+
+// frameScale returns the scale of a frame, 1 if not set.
+func frameScale(frame *FrameDesc) float64 {
+	if frame.Scale == 0 {
+		return 1
+	}
+	return frame.Scale
+}
+
+// frameOpacity returns the opacity of a frame, 1 if not set.
+func frameOpacity(frame *FrameDesc) float64 {
+	if frame.Opacity == nil {
+		return 1
+	}
+	return *frame.Opacity
+}
+
+// hasTransform reports whether a frame is faded, rotated or scaled.
+func hasTransform(frame *FrameDesc) bool {
+	return frameOpacity(frame) < 1 || math.Mod(frame.Rotation, 360) != 0 || frameScale(frame) != 1
+}
+
+// frameMatrix maps the coordinates of a frame placed at x, y to those of its
+// parent, scaling and rotating it clockwise about its origin.
+func frameMatrix(frame *FrameDesc, x, y int) f64.Aff3 {
+	ox, oy := 0.5, 0.5
+	if len(frame.Origin) == 2 {
+		ox, oy = frame.Origin[0], frame.Origin[1]
+	}
+	ox *= float64(frame.Width)
+	oy *= float64(frame.Height)
+	k := frameScale(frame)
+	sin, cos := math.Sincos(frame.Rotation * math.Pi / 180)
+	a, b, d, e := k*cos, -k*sin, k*sin, k*cos
+	return f64.Aff3{
+		a, b, float64(x) + ox - a*ox - b*oy,
+		d, e, float64(y) + oy - d*ox - e*oy,
+	}
+}
+
+// transformedRect returns the pixels covered by a rectangle mapped by m, with
+// a pixel to spare for the smoothed edges.
+func transformedRect(r image.Rectangle, m f64.Aff3) image.Rectangle {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range [4][2]int{{r.Min.X, r.Min.Y}, {r.Max.X, r.Min.Y}, {r.Min.X, r.Max.Y}, {r.Max.X, r.Max.Y}} {
+		px := m[0]*float64(p[0]) + m[1]*float64(p[1]) + m[2]
+		py := m[3]*float64(p[0]) + m[4]*float64(p[1]) + m[5]
+		minX, maxX = math.Min(minX, px), math.Max(maxX, px)
+		minY, maxY = math.Min(minY, py), math.Max(maxY, py)
+	}
+	return image.Rect(int(math.Floor(minX))-1, int(math.Floor(minY))-1, int(math.Ceil(maxX))+1, int(math.Ceil(maxY))+1)
+}
+
+// transformInto draws an image mapped by m over dst, whose top left pixel
+// lies at off in the coordinates m maps to. The image is padded by a
+// transparent pixel, so the interpolation smooths its edges.
+func transformInto(dst *image.RGBA, off image.Point, src *image.RGBA, m f64.Aff3) {
+	b := src.Bounds()
+	padded := image.NewRGBA(b.Inset(-1))
+	draw.Draw(padded, b, src, b.Min, draw.Src)
+	m[2] -= float64(off.X)
+	m[5] -= float64(off.Y)
+	xdraw.BiLinear.Transform(dst, m, padded, padded.Bounds(), xdraw.Over, nil)
+}
+
+// fadeImage returns an image with its opacity multiplied by opacity.
+func fadeImage(img *image.RGBA, opacity float64) *image.RGBA {
+	faded := image.NewRGBA(img.Bounds())
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(opacity * 255))})
+	draw.DrawMask(faded, faded.Bounds(), img, img.Bounds().Min, mask, image.Point{}, draw.Src)
+	return faded
+}
+
+// layerMargin is how far the shadow and blur of a frame reach beyond it.
+func layerMargin(frame *FrameDesc) int {
+	margin := 0
+	if frame.Blur > 0 {
+		margin = blurPad(frame.Blur)
+	}
+	if s := frame.Shadow; s != nil {
+		margin = maxInt(margin, maxInt(abs(s.X), abs(s.Y))+blurPad(shadowSigma(s)))
+	}
+	return margin
+}
+
+// renderTransformed composites a frame with its shadow into its parent,
+// scaled and rotated about its origin and faded by its opacity. The backdrop
+// is taken from below the transformed frame and faded with it.
+func (x *RequestsHandler) renderTransformed(frame *FrameDesc, shape *frameShape, xul, yul int, img *render.CompositeM) {
+	margin := layerMargin(frame)
+	layer, off := x.renderLayer(frame, shape)
+	// the layer and the group are placed in the frame coordinates
+	lr := layer.Bounds().Sub(off)
+	if frame.Blur > 0 {
+		var pad int
+		layer, pad = blurImage(layer, frame.Blur)
+		lr = lr.Inset(-pad)
+	}
+	gr := image.Rect(0, 0, frame.Width, frame.Height).Inset(-margin).Union(lr)
+	group := render.NewCompositeM()
+	if frame.Shadow != nil {
+		appendShadow(group, shape.outerMask(), frame.Shadow, float64(-gr.Min.X), float64(-gr.Min.Y))
+	}
+	lpos := lr.Min.Sub(gr.Min)
+	group.AppendOffset(render.NewSprite(0, 0, layer), floatgeom.Point2{float64(lpos.X), float64(lpos.Y)})
+	local := flattenComposite(group, gr.Dx(), gr.Dy())
+
+	m := frameMatrix(frame, xul, yul)
+	gm := m
+	gm[2] += m[0]*float64(gr.Min.X) + m[1]*float64(gr.Min.Y)
+	gm[5] += m[3]*float64(gr.Min.X) + m[4]*float64(gr.Min.Y)
+	r := transformedRect(local.Bounds(), gm)
+	out := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+
+	if frame.BackdropBlur > 0 {
+		outer := image.NewRGBA(image.Rect(0, 0, frame.Width, frame.Height))
+		draw.DrawMask(outer, outer.Bounds(), image.White, image.Point{}, shape.outerMask(), image.Point{}, draw.Src)
+		clip := image.NewRGBA(out.Bounds())
+		transformInto(clip, r.Min, outer, m)
+		draw.Draw(out, out.Bounds(), backdrop(img, r, frame.BackdropBlur, alphaMask(clip)), image.Point{}, draw.Src)
+	}
+	transformInto(out, r.Min, local, gm)
+	if op := frameOpacity(frame); op < 1 {
+		out = fadeImage(out, op)
+	}
+	img.AppendOffset(render.NewSprite(0, 0, out), floatgeom.Point2{float64(r.Min.X), float64(r.Min.Y)})
+}
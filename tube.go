@@ -106,7 +106,10 @@ func (x *RequestsHandler) ProcessTube(src []byte) (error, string) {
 			if err != nil {
 				return err, ""
 			}
-			for _, v := range Tprecalcs {
+			if _, err = x.WriteImageMeta(hash, imout); err != nil {
+				return err, ""
+			}
+			for _, v := range x.Tprecalcs {
 				if err = x.WriteToScaled(hash, imout, v); err != nil {
 					return err, ""
 				}